@@ -8,479 +8,5098 @@ To run this code, save it in a file named main.go and execute the following comm
 */
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/bits"
+	mathrand "math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // timezone database for active_window, the runtime image has no tzdata
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // region Provider and Config Structs
 type Provider struct {
-	Uri        string `json:"uri"`
-	Username   string `json:"username,omitempty"`
-	Password   string `json:"passwd,omitempty"`
-	Domain     string `json:"domain,omitempty"`
-	Iid6       string `json:"iid6,omitempty"`
-	DelayMs    int    `json:"delay_ms,omitempty"` // optional delay in milliseconds before request
-	Iid6Masked net.IP `json:"-"`                  // will be set later if Iid6 is valid
+	Uri                 string             `json:"uri"`
+	Username            string             `json:"username,omitempty"`
+	Password            string             `json:"passwd,omitempty"`
+	Domain              string             `json:"domain,omitempty"`
+	Domains             []string           `json:"domains,omitempty"` // optional domains, one request per domain, alternative to domain
+	Iid6                string             `json:"iid6,omitempty"`
+	Iid4                string             `json:"iid4,omitempty"`                   // optional IPv4 host part combined with ip4lanprefix, e.g. "0.0.0.11"
+	Macs                []string           `json:"macs,omitempty"`                   // optional MAC addresses, one EUI-64 IID6 and request per MAC
+	DelayMs             int                `json:"delay_ms,omitempty"`               // optional delay in milliseconds before request
+	When                string             `json:"when,omitempty"`                   // optional condition on request params, e.g. "dualstack==1"
+	FailWhenContains    []string           `json:"fail_when_contains,omitempty"`     // optional error tokens for providers that only respond on failure
+	SuccessRegex        string             `json:"success_regex,omitempty"`          // optional regex for providers without return codes, a match in the body or a header is good
+	FailureRegex        string             `json:"failure_regex,omitempty"`          // optional regex for providers without return codes, a match in the body or a header is 911
+	UserAgent           string             `json:"user_agent,omitempty"`             // optional outbound User-Agent template, supports <useragent>
+	TtlHeader           string             `json:"ttl_header,omitempty"`             // optional response header with the seconds until the next update is allowed
+	MinUpdateIntervalS  int                `json:"min_update_interval_s,omitempty"`  // optional minimum seconds between two updates, default if no TTL hint is returned
+	ActiveWindow        string             `json:"active_window,omitempty"`          // optional time-of-day range with optional timezone, e.g. "22:00-06:00 Europe/Berlin"
+	DefaultCode         string             `json:"default_code,omitempty"`           // optional return code if the response matches no return code, default "unknown"
+	Serialize           bool               `json:"serialize,omitempty"`              // optional, at most one in-flight request per provider host and account
+	VerifyDns           bool               `json:"verify_dns,omitempty"`             // optional, verify via DNS lookup that the domain resolves to the sent addresses
+	ForwardHeaders      []string           `json:"forward_headers,omitempty"`        // optional allowlist of client request headers to forward, overrides FORWARD_HEADERS
+	DryRun              bool               `json:"dry_run,omitempty"`                // optional, build and log the request, but don't send it
+	PasswordFile        string             `json:"passwd_file,omitempty"`            // optional path of a file with the passwd, e.g. a Docker secret
+	Credentials         string             `json:"credentials,omitempty"`            // optional name of a credential set in CREDENTIALS, alternative to username/passwd
+	TimeoutMs           int                `json:"timeout_ms,omitempty"`             // optional timeout of the request in milliseconds, overrides HTTP_TIMEOUT_MS
+	ResponseIpSource    string             `json:"response_ip_source,omitempty"`     // optional source of the IP in the response line: "request" (default) or "body"
+	Retries             int                `json:"retries,omitempty"`                // optional number of retries on network errors and transient return codes
+	RetryBackoffMs      int                `json:"retry_backoff_ms,omitempty"`       // optional initial delay between retries in milliseconds, doubled on every retry, default 1000
+	RetryOn             []string           `json:"retry_on,omitempty"`               // optional transient return codes that are retried, default ["911", "dnserr"]
+	RetryOnUnknown      bool               `json:"retry_on_unknown,omitempty"`       // optional, responses without a known return code are retried, regardless of default_code
+	Auth                string             `json:"auth,omitempty"`                   // optional way to send username and passwd: "query" (default, via placeholders) or "basic" (HTTP Basic Auth)
+	TlsServerName       string             `json:"tls_server_name,omitempty"`        // optional server name for SNI and the certificate verification, default is the host of uri
+	ClientCertFile      string             `json:"client_cert_file,omitempty"`       // optional PEM file of a TLS client certificate for mutual TLS, requires client_key_file
+	ClientKeyFile       string             `json:"client_key_file,omitempty"`        // optional PEM file of the private key of client_cert_file
+	CaFile              string             `json:"ca_file,omitempty"`                // optional PEM bundle of the CAs that verify the provider, instead of CA_FILE or the system CAs
+	InsecureSkipVerify  bool               `json:"insecure_skip_verify,omitempty"`   // optional, the certificate of the provider is not verified, default is false
+	Method              string             `json:"method,omitempty"`                 // optional HTTP method: GET (default), POST, PUT or PATCH
+	Body                string             `json:"body,omitempty"`                   // optional body template for POST, PUT and PATCH, supports the same placeholders as uri
+	ContentType         string             `json:"content_type,omitempty"`           // optional Content-Type of the body, default "application/x-www-form-urlencoded"
+	CheckResponseIp     bool               `json:"check_response_ip,omitempty"`      // optional, a success with an IP in the response that wasn't sent is treated as unknown
+	SuccessWhenEchoesIp bool               `json:"success_when_echoes_ip,omitempty"` // optional, a body that is only the sent IPv4 or IPv6 address is treated as good
+	RedirectAsSuccess   bool               `json:"redirect_as_success,omitempty"`    // optional, a 3xx response is not followed, but treated as good
+	RequireStatus       int                `json:"require_status,omitempty"`         // optional HTTP status required for success, any other status is 911
+	Params              map[string]string  `json:"params,omitempty"`                 // optional query params appended to uri, maps a placeholder name to the param name of the provider, e.g. {"ipaddr": "myip"}
+	HealthCheck         bool               `json:"health_check,omitempty"`           // optional, the provider is probed by the deep health check
+	HealthCheckUrl      string             `json:"health_check_url,omitempty"`       // optional URL probed instead of the host of uri, implies health_check
+	Passthrough         bool               `json:"passthrough,omitempty"`            // optional, the HTTP status and body of this provider are returned to the client unchanged
+	Family              string             `json:"family,omitempty"`                 // optional address family: "any" (default), "ipv4" or "ipv6", skipped if the request has no address of the family
+	Enabled             *bool              `json:"enabled,omitempty"`                // optional, false skips the provider without removing it, default true
+	Description         string             `json:"description,omitempty"`            // optional free text, not evaluated
+	Iid6Masked          net.IP             `json:"-"`                                // will be set later if Iid6 is valid
+	Iid4Masked          net.IP             `json:"-"`                                // will be set later if Iid4 is valid
+	EnvValues           []placeholderValue `json:"-"`                                // will be set later if the templates reference <env:VAR>
+	OriginalIndex       int                `json:"-"`                                // will be set later to the index in PROVIDERS, shared by the copies expanded from domains and macs
+	ExpandedDomain      bool               `json:"-"`                                // will be set later if the copy was expanded from domains
+	ExpandedMac         string             `json:"-"`                                // will be set later to the MAC the copy was expanded from
+
+	WhenConditions     []WhenCondition `json:"-"` // will be set later if When is valid
+	SuccessRegexParsed *regexp.Regexp  `json:"-"` // will be set later if SuccessRegex is valid
+	FailureRegexParsed *regexp.Regexp  `json:"-"` // will be set later if FailureRegex is valid
+	ActiveWindowParsed *ActiveWindow   `json:"-"` // will be set later if ActiveWindow is valid
+	HttpClient         *http.Client    `json:"-"` // will be set later if the provider has TLS options, otherwise the shared client is used
 }
 
-type Config struct {
-	Username   string     // env.USER_NAME
-	Password   string     // env.USER_PASSWORD
-	Domain     string     // env.USER_DOMAIN_NAME
-	Providers  []Provider // env.PROVIDERS (JSON-Array)
-	LogVerbose bool       // env.LOG_VERBOSE (optional, default: false)
+// Named credential set that can be referenced by providers
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"passwd"`
 }
 
-// Loads environment variables and deserializes them into a Config struct
-func LoadConfigFromEnv() (*Config, error) {
-	cfg := &Config{}
-	cfg.Username = os.Getenv("USER_NAME")
-	if cfg.Username == "" {
-		cfg.Username = "user"
-	}
+// Settings that can be loaded from CONFIG_FILE instead of the environment variables
+type FileConfig struct {
+	Username   string     `json:"username,omitempty"`    // optional, overrides USER_NAME
+	Password   string     `json:"password,omitempty"`    // optional, overrides USER_PASSWORD
+	Domain     string     `json:"domain,omitempty"`      // optional, overrides USER_DOMAIN_NAME
+	Providers  []Provider `json:"providers,omitempty"`   // optional, overrides PROVIDERS
+	LogVerbose *bool      `json:"log_verbose,omitempty"` // optional, overrides LOG_VERBOSE
+}
 
-	cfg.Password = os.Getenv("USER_PASSWORD")
-	if cfg.Password == "" {
-		return nil, fmt.Errorf("USER_PASSWORD is required and must not be empty")
+// Returns the secret of the environment variable name, or the trimmed content of the file name_FILE
+// (e.g. a Docker or Kubernetes secret). If both are set, the file is preferred.
+func secretFromEnv(name string) (string, error) {
+	path := strings.TrimSpace(os.Getenv(name + "_FILE"))
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		log.Printf("[WARNING] Both %s and %s_FILE are set, using %s_FILE\n", name, name, name)
 	}
+	secret, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return secret, nil
+}
 
-	cfg.Domain = os.Getenv("USER_DOMAIN_NAME")
-	if cfg.Domain == "" {
-		cfg.Domain = "dyndns.multiplexer.internal"
+// Returns the trimmed content of a secret file
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
 	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	providersJson := os.Getenv("PROVIDERS")
-	if providersJson != "" {
-		err := json.Unmarshal([]byte(providersJson), &cfg.Providers)
-		if err != nil {
-			return nil, err
+// Decodes PROVIDERS strictly: unknown fields and data after the array are errors, which are reported with their position
+func decodeProvidersStrict(providersJson string) ([]Provider, error) {
+	dec := json.NewDecoder(strings.NewReader(providersJson))
+	var rawProviders []json.RawMessage
+	if err := dec.Decode(&rawProviders); err != nil {
+		return nil, fmt.Errorf("invalid PROVIDERS: %v", describeJsonError(err, dec.InputOffset()))
+	}
+	// The trailing data starts where the whitespace after the array ends
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		offset := len(providersJson) - len(strings.TrimLeft(providersJson[end:], " \t\r\n"))
+		return nil, fmt.Errorf("invalid PROVIDERS: unexpected data after the array at offset %d", offset)
+	}
+	providers := make([]Provider, len(rawProviders))
+	for i, rawProvider := range rawProviders {
+		providerDec := json.NewDecoder(bytes.NewReader(rawProvider))
+		providerDec.DisallowUnknownFields()
+		if err := providerDec.Decode(&providers[i]); err != nil {
+			return nil, fmt.Errorf("provider at index %d is invalid: %v", i, describeJsonError(err, providerDec.InputOffset()))
 		}
 	}
+	return providers, nil
+}
 
-	// LOG_VERBOSE: "true" (case-insensitive) => true, else false
-	logVerboseEnv := strings.ToLower(os.Getenv("LOG_VERBOSE"))
-	cfg.LogVerbose = logVerboseEnv == "true"
-
-	if len(cfg.Providers) == 0 {
-		return nil, fmt.Errorf("no provider defined (PROVIDERS is empty or missing)")
+// Adds the position to a JSON decoding error, the offset is used if the error doesn't contain one, e.g. for unknown fields
+func describeJsonError(err error, offset int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%v (at offset %d)", err, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("%v (at offset %d)", err, typeErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return fmt.Errorf("unexpected end of JSON input")
+	default:
+		return fmt.Errorf("%v (near offset %d)", err, offset)
 	}
-	for i, p := range cfg.Providers {
-		if strings.TrimSpace(p.Uri) == "" {
-			return nil, fmt.Errorf("provider at index %d is missing a URI", i)
-		} else {
-			if p.Iid6 != "" {
-				//Parse and validate the interface ID.
-				ifaceIP := net.ParseIP(p.Iid6)
-				if ifaceIP == nil || ifaceIP.To16() == nil {
-					return nil, fmt.Errorf("invalid interface ID: %s", p.Iid6)
-				} else {
-					p.Iid6Masked = ifaceIP
-					cfg.Providers[i] = p // Update the slice with the modified provider
+}
 
-					if cfg.LogVerbose {
-						log.Printf("Provider[%d]: Parsed IID6 %s to %s\n", i, p.Iid6, p.Iid6Masked.String())
-					}
-				}
-			}
-		}
+// Reads and deserializes the CONFIG_FILE
+func loadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONFIG_FILE: %v", err)
 	}
-	return cfg, nil
+	fileCfg := &FileConfig{}
+	if err := json.Unmarshal(data, fileCfg); err != nil {
+		return nil, fmt.Errorf("invalid CONFIG_FILE %s: %v", path, err)
+	}
+	return fileCfg, nil
 }
 
-// endregion
+type Config struct {
+	ConfigFile               string                // env.CONFIG_FILE (optional, JSON file with username, password, domain, providers and log_verbose)
+	Username                 string                // env.USER_NAME
+	Password                 string                // env.USER_PASSWORD
+	Domain                   string                // env.USER_DOMAIN_NAME
+	ListenPort               int                   // env.LISTEN_PORT (optional, default: 8080)
+	BindAddr                 string                // env.BIND_ADDR (optional, default: empty = all interfaces)
+	UpdatePath               string                // env.UPDATE_PATH (optional, default: /update)
+	HealthPath               string                // env.HEALTH_PATH (optional, default: /health)
+	ShutdownTimeoutMs        int                   // env.SHUTDOWN_TIMEOUT_MS (optional, default: 5000)
+	TlsCertFile              string                // env.TLS_CERT_FILE (optional, HTTPS if set together with TLS_KEY_FILE)
+	TlsKeyFile               string                // env.TLS_KEY_FILE (optional, HTTPS if set together with TLS_CERT_FILE)
+	TlsMinVersion            uint16                // env.TLS_MIN_VERSION (optional, 1.0, 1.1, 1.2 or 1.3, default: 1.2)
+	Providers                []Provider            // env.PROVIDERS (JSON-Array)
+	Credentials              map[string]Credential // env.CREDENTIALS (optional, JSON-Object of named credential sets)
+	LogVerbose               bool                  // env.LOG_VERBOSE (optional, default: false)
+	LogMaskDomain            bool                  // env.LOG_MASK_DOMAIN (optional, default: false)
+	LogFormat                string                // env.LOG_FORMAT (optional, text or json, default: text)
+	LogLevel                 string                // env.LOG_LEVEL (optional, error, warn, info or debug, default: info, debug if LogVerbose)
+	LogGroupByProvider       bool                  // env.LOG_GROUP_BY_PROVIDER (optional, default: false)
+	TrustProxy               bool                  // env.TRUST_PROXY (optional, default: false, only affects logging)
+	DnsServer                string                // env.DNS_SERVER (optional, default: system resolver)
+	SuccessCondition         string                // env.SUCCESS_CONDITION (optional, default: highest severity wins)
+	SeverityMap              map[string]int        // env.SEVERITY_MAP (optional, JSON-Object of return code -> severity, merged over the DynDNS v2 severities)
+	MaxParamLength           int                   // env.MAX_PARAM_LENGTH (optional, default: 255)
+	HttpTimeoutMs            int                   // env.HTTP_TIMEOUT_MS (optional, default: 60000)
+	CaFile                   string                // env.CA_FILE (optional, PEM bundle of the CAs that verify the providers, default: system CAs)
+	MaxResponseBytes         int                   // env.MAX_RESPONSE_BYTES (optional, default: 65536)
+	UserAgent                string                // env.USER_AGENT (optional, default: dyndns-multiplexer/<version>)
+	OtelEnabled              bool                  // env.OTEL_ENABLED (optional, default: false)
+	AdminUsername            string                // env.ADMIN_USER_NAME (optional, default: admin)
+	AdminPassword            string                // env.ADMIN_PASSWORD (optional, admin endpoints are disabled if empty)
+	AllowNoProviders         bool                  // env.ALLOW_NO_PROVIDERS (optional, default: false)
+	AllowMissingEnv          bool                  // env.ALLOW_MISSING_ENV (optional, default: false)
+	Passthrough              bool                  // env.PASSTHROUGH (optional, default: false, requires exactly one provider)
+	DuplicateProviders       string                // env.DUPLICATE_PROVIDERS (optional, warn or error, default: warn)
+	MaxConcurrency           int                   // env.MAX_CONCURRENCY (optional, default: 0 = unlimited)
+	ResponseDelayMs          int                   // env.RESPONSE_DELAY_MS (optional, default: 0)
+	MaxConcurrentUpdates     int                   // env.MAX_CONCURRENT_UPDATES (optional, default: 0 = unlimited)
+	ConcurrentUpdatesMode    string                // env.CONCURRENT_UPDATES_MODE (optional, reject or queue, default: reject)
+	ConcurrentUpdatesQueueMs int                   // env.CONCURRENT_UPDATES_QUEUE_TIMEOUT_MS (optional, default: 10000)
+	ProviderStrategy         string                // env.PROVIDER_STRATEGY (optional, all or failover, default: all)
+	RateLimitRps             float64               // env.RATE_LIMIT_RPS (optional, /update requests per second and client IP, default: 0 = unlimited)
+	RateLimitBurst           int                   // env.RATE_LIMIT_BURST (optional, default: RATE_LIMIT_RPS rounded up, at least 1)
+	ThrottleStatus           string                // env.THROTTLE_STATUS (optional, return code if the server throttles a request, default: 911)
+	ResponseIp6Mode          string                // env.RESPONSE_IP6_MODE (optional, full, mask or omit, default: full)
+	StrictHttpStatus         bool                  // env.STRICT_HTTP_STATUS (optional, default: false = HTTP 200 for all aggregated return codes)
+	ForwardHeaders           []string              // env.FORWARD_HEADERS (optional, comma separated allowlist of client request headers)
+	VerifyDnsServer          string                // env.VERIFY_DNS_SERVER (optional, default: DNS_SERVER or system resolver)
+	VerifyDnsRetries         int                   // env.VERIFY_DNS_RETRIES (optional, default: 3)
+	VerifyDnsTimeoutMs       int                   // env.VERIFY_DNS_TIMEOUT_MS (optional, default: 2000)
+	CountersFile             string                // env.COUNTERS_FILE (optional, counters are not persisted if empty)
+	CountersPersistIntervalS int                   // env.COUNTERS_PERSIST_INTERVAL_S (optional, default: 300)
+	LastResultFile           string                // env.LAST_RESULT_FILE (optional, the last result is not written if empty)
+	IpCacheTtlS              int                   // env.IP_CACHE_TTL_S (optional, default: 0 = providers are always updated)
+	StateFile                string                // env.STATE_FILE (optional, the IP cache is not persisted if empty)
+	HealthCheckTimeoutMs     int                   // env.HEALTH_CHECK_TIMEOUT_MS (optional, timeout of the deep health check, default: 5000)
 
-// region main
-var (
-	config    *Config
-	globalErr error
-)
+	Resolver             *net.Resolver     // derived from DnsServer, nil uses the system resolver
+	CaPool               *x509.CertPool    // derived from CaFile, nil uses the system CAs
+	HttpClient           *http.Client      // shared client for all provider requests, derived from Resolver and CaPool
+	VerifyResolver       *net.Resolver     // derived from VerifyDnsServer or DnsServer, nil uses net.DefaultResolver
+	SuccessConditionExpr *SuccessCondition // derived from SuccessCondition
+}
 
-func main() {
-	config, globalErr = LoadConfigFromEnv()
-	if globalErr != nil {
-		log.Printf("Config error: %v", globalErr)
-	} else {
-		if config.LogVerbose {
-			log.Println("Verbose logging enabled. WARNING: This may expose sensitive information in logs. Use it with caution.")
-		} else {
-			log.Println("Verbose logging disabled")
-		}
+// Returns false if the provider is disabled with "enabled": false
+func (p Provider) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
 
-		// Log provider attributes without username and password
-		for i, p := range config.Providers {
-			var iid6Parsed string
-			if p.Iid6Masked != nil {
-				iid6Parsed = p.Iid6Masked.String()
-			} else {
-				iid6Parsed = ""
-			}
+type noRedirectKey struct{}
 
-			log.Printf("Provider[%d]: uri=%s, domain=%s, iid6=%s, delay_ms=%d", i, p.Uri, p.Domain, iid6Parsed, p.DelayMs)
-		}
+// Redirect policy of the shared client: redirects are followed (at most 10, like the default policy),
+// unless the request context is marked with noRedirectKey, e.g. for providers with redirect_as_success
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if noRedirect, _ := req.Context().Value(noRedirectKey{}).(bool); noRedirect {
+		return http.ErrUseLastResponse
 	}
-
-	http.HandleFunc("/health", healthEndpoint)
-	http.HandleFunc("/update", dyndnsHandler)
-
-	port := "8080"
-	log.Printf("app started on :%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
 }
 
-// endregion
+// Default port of the HTTP server, also used if the config is invalid
+const defaultListenPort = 8080
 
-// region healthEndpoint
+// Default paths of the update and health endpoints, also used if the config is invalid
+const (
+	defaultUpdatePath = "/update"
+	defaultHealthPath = "/health"
+)
 
-func healthEndpoint(w http.ResponseWriter, r *http.Request) {
-	if globalErr == nil {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "OK")
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, "UNHEALTHY: config error. "+globalErr.Error())
+// Paths of the other endpoints, UPDATE_PATH and HEALTH_PATH must not collide with them
+var reservedPaths = []string{"/ready", "/status", "/version", "/metrics", "/combine", "/placeholders", "/inflight"}
+
+// Validates a configured endpoint path, e.g. "/nic/update"
+func validateEndpointPath(name string, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s must start with /: %s", name, path)
+	}
+	// Whitespace, braces and ? or # would be misread as a pattern or query by the router
+	if strings.ContainsAny(path, " \t{}?#") {
+		return fmt.Errorf("%s must be a plain path without whitespace, {, }, ? or #: %s", name, path)
+	}
+	if slices.Contains(reservedPaths, path) {
+		return fmt.Errorf("%s collides with the endpoint %s", name, path)
 	}
+	return nil
 }
 
-// endregion
+// Minimum TLS versions of TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-// region dyndnsHandler
+// Returns true if the server is served with HTTPS
+func (c *Config) TlsEnabled() bool {
+	return c.TlsCertFile != "" && c.TlsKeyFile != ""
+}
 
-// region QueryParams
-// Pair of partially resolved URI and Provider
-type QueryParams struct {
-	Username      string     // mandatory
-	Password      string     // mandatory
-	Domain        string     // mandatory
-	IpAddr        string     // optional, one of IpAddr or Ip6Addr must be set
-	Ip6Addr       string     // optional, one of IpAddr or Ip6Addr must be set
-	Ip6LanPrefix  string     // optional
-	Ip6LanNetwork *net.IPNet // optional, derived from Ip6LanPrefix
-	Dualstack     string     // optional
+// Returns the listen address of the HTTP server, e.g. ":8080" or "127.0.0.1:8080"
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.BindAddr, strconv.Itoa(c.ListenPort))
 }
 
-// Parse and validate QueryParams from http.Request
-func ParseQueryParams(r *http.Request) (*QueryParams, error) {
-	q := r.URL.Query()
-	params := &QueryParams{
-		Username:      q.Get("username"),
-		Password:      q.Get("passwd"),
-		Domain:        q.Get("domain"),
-		IpAddr:        q.Get("ipaddr"),
-		Ip6Addr:       q.Get("ip6addr"),
-		Ip6LanPrefix:  q.Get("ip6lanprefix"),
-		Ip6LanNetwork: nil, // will be set later if Ip6LanPrefix is valid
-		Dualstack:     q.Get("dualstack"),
-	}
-	// Validate mandatory fields
-	if params.Username == "" {
-		return nil, fmt.Errorf("missing mandatory query param: username")
-	}
-	if params.Password == "" {
-		return nil, fmt.Errorf("missing mandatory query param: passwd")
+// Loads environment variables and deserializes them into a Config struct
+func LoadConfigFromEnv() (*Config, error) {
+	cfg := &Config{}
+
+	// CONFIG_FILE: optional JSON file, its values take precedence over the environment variables
+	fileCfg := &FileConfig{}
+	cfg.ConfigFile = strings.TrimSpace(os.Getenv("CONFIG_FILE"))
+	if cfg.ConfigFile != "" {
+		var err error
+		fileCfg, err = loadConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if params.Domain == "" {
-		return nil, fmt.Errorf("missing mandatory query param: domain")
+
+	cfg.Username = fileCfg.Username
+	if cfg.Username == "" {
+		cfg.Username = os.Getenv("USER_NAME")
 	}
-	// At least one of IpAddr or Ip6Addr must be set
-	if params.IpAddr == "" && params.Ip6Addr == "" {
-		return nil, fmt.Errorf("either ipaddr or ip6addr must be set")
+	if cfg.Username == "" {
+		cfg.Username = "user"
 	}
 
-	// parse ip6lanprefix if set
-	if params.Ip6LanPrefix != "" {
-		//e.g. "cafe:babe:dead:beef::/64" or "babe:beef::/32"
-		_, network, err := net.ParseCIDR(params.Ip6LanPrefix)
+	cfg.Password = fileCfg.Password
+	if cfg.Password == "" {
+		password, err := secretFromEnv("USER_PASSWORD")
 		if err != nil {
-			return nil, fmt.Errorf("invalid CIDR prefix: %v", err)
-		} else if network.IP.To16() == nil {
-			// Ensure the prefix is for IPv6.
-			return nil, fmt.Errorf("the provided CIDR %s is not an IPv6 prefix", params.Ip6LanPrefix)
-		} else {
-			params.Ip6LanNetwork = network
+			return nil, err
 		}
+		cfg.Password = password
+	}
+	if cfg.Password == "" {
+		return nil, fmt.Errorf("USER_PASSWORD (or USER_PASSWORD_FILE or password in CONFIG_FILE) is required and must not be empty")
 	}
 
-	return params, nil
-}
+	cfg.Domain = fileCfg.Domain
+	if cfg.Domain == "" {
+		cfg.Domain = os.Getenv("USER_DOMAIN_NAME")
+	}
+	if cfg.Domain == "" {
+		cfg.Domain = "dyndns.multiplexer.internal"
+	}
 
-// endregion
+	// LISTEN_PORT and BIND_ADDR: optional address of the HTTP server
+	cfg.ListenPort = defaultListenPort
+	if listenPortEnv := strings.TrimSpace(os.Getenv("LISTEN_PORT")); listenPortEnv != "" {
+		listenPort, err := strconv.Atoi(listenPortEnv)
+		if err != nil || listenPort < 1 || listenPort > 65535 {
+			return nil, fmt.Errorf("LISTEN_PORT must be an integer between 1 and 65535: %s", listenPortEnv)
+		}
+		cfg.ListenPort = listenPort
+	}
+	cfg.BindAddr = strings.TrimSpace(os.Getenv("BIND_ADDR"))
 
-// region StatusTracker
-// Tracks status and severity for DynDNS responses
-type StatusTracker struct {
-	SeverityMap  map[string]int
-	Highest      int
-	FinalStatus  string
-	HeaderStatus string
-	ResponseIp   string
-}
+	// UPDATE_PATH and HEALTH_PATH: optional paths of the update and health endpoints, e.g. "/nic/update"
+	cfg.UpdatePath = cmp.Or(strings.TrimSpace(os.Getenv("UPDATE_PATH")), defaultUpdatePath)
+	if err := validateEndpointPath("UPDATE_PATH", cfg.UpdatePath); err != nil {
+		return nil, err
+	}
+	cfg.HealthPath = cmp.Or(strings.TrimSpace(os.Getenv("HEALTH_PATH")), defaultHealthPath)
+	if err := validateEndpointPath("HEALTH_PATH", cfg.HealthPath); err != nil {
+		return nil, err
+	}
+	if cfg.UpdatePath == cfg.HealthPath {
+		return nil, fmt.Errorf("UPDATE_PATH and HEALTH_PATH must not be the same path: %s", cfg.UpdatePath)
+	}
 
-func NewStatusTracker(ipv4, ipv6 string) *StatusTracker {
-	var responseIp string
-	if ipv4 == "" {
-		responseIp = ipv6
-	} else {
-		responseIp = ipv4
-		if ipv6 != "" {
-			responseIp = ipv4 + " " + ipv6
+	// SHUTDOWN_TIMEOUT_MS: optional grace period for in-flight requests on shutdown
+	cfg.ShutdownTimeoutMs = defaultShutdownTimeoutMs
+	if shutdownTimeoutEnv := strings.TrimSpace(os.Getenv("SHUTDOWN_TIMEOUT_MS")); shutdownTimeoutEnv != "" {
+		shutdownTimeout, err := strconv.Atoi(shutdownTimeoutEnv)
+		if err != nil || shutdownTimeout < 1 {
+			return nil, fmt.Errorf("SHUTDOWN_TIMEOUT_MS must be a positive integer: %s", shutdownTimeoutEnv)
 		}
+		cfg.ShutdownTimeoutMs = shutdownTimeout
 	}
 
-	// Severity values according to DynDNS v2 protocol (https://help.dyn.com/remote-access-api/return-codes/)
-	return &StatusTracker{
-		SeverityMap: map[string]int{
-			"badauth":  12,
-			"notfqdn":  11,
-			"nohost":   10,
-			"numhost":  9,
-			"abuse":    8,
-			"badagent": 7,
-			"!yours":   6,
-			"!donator": 5,
-			"911":      4,
-			"dnserr":   3,
-			"unknown":  2,
-			"good":     1,
-			"ok":       0,
-			"nochg":    -1,
-		},
-		Highest:      -1,
-		FinalStatus:  "nochg " + responseIp,
-		HeaderStatus: "nochg",
-		ResponseIp:   responseIp,
+	// TLS_CERT_FILE, TLS_KEY_FILE and TLS_MIN_VERSION: optional HTTPS, plain HTTP if neither file is set
+	cfg.TlsCertFile = strings.TrimSpace(os.Getenv("TLS_CERT_FILE"))
+	cfg.TlsKeyFile = strings.TrimSpace(os.Getenv("TLS_KEY_FILE"))
+	if (cfg.TlsCertFile == "") != (cfg.TlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TlsEnabled() {
+		// Fails early with a config error instead of a crash when the server starts
+		if _, err := tls.LoadX509KeyPair(cfg.TlsCertFile, cfg.TlsKeyFile); err != nil {
+			return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE are not a valid certificate and key: %v", err)
+		}
+	}
+	cfg.TlsMinVersion = tls.VersionTLS12
+	if tlsMinVersionEnv := strings.TrimSpace(os.Getenv("TLS_MIN_VERSION")); tlsMinVersionEnv != "" {
+		tlsMinVersion, ok := tlsVersions[tlsMinVersionEnv]
+		if !ok {
+			return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.0, 1.1, 1.2 or 1.3: %s", tlsMinVersionEnv)
+		}
+		cfg.TlsMinVersion = tlsMinVersion
 	}
-}
 
-// Checks and updates severity and finalStatus
-func (s *StatusTracker) CheckStatus(result string, exactReturnCodeMatch bool) {
-	status := "unknown"
-	sev := s.SeverityMap[status] // fallback
-	if exactReturnCodeMatch {
-		for k := range s.SeverityMap {
-			if result == k {
-				sev = s.SeverityMap[k]
-				status = k
-				break
+	providersJson := os.Getenv("PROVIDERS")
+	if fileCfg.Providers != nil {
+		cfg.Providers = fileCfg.Providers
+	} else if providersJson != "" {
+		// PROVIDERS_STRICT: "false" (case-insensitive) => lenient decoding, else strict
+		if strings.ToLower(strings.TrimSpace(os.Getenv("PROVIDERS_STRICT"))) == "false" {
+			err := json.Unmarshal([]byte(providersJson), &cfg.Providers)
+			if err != nil {
+				return nil, err
 			}
-		}
-	} else {
-		for k := range s.SeverityMap {
-			if strings.HasPrefix(result, k) || strings.Contains(result, k) {
-				sev = s.SeverityMap[k]
-				status = k
-				break
+		} else {
+			providers, err := decodeProvidersStrict(providersJson)
+			if err != nil {
+				return nil, err
 			}
+			cfg.Providers = providers
 		}
 	}
-	log.Println("Matched return code: " + status)
-	if sev > s.Highest {
-		s.Highest = sev
-		s.HeaderStatus = status
-		// Set finalStatus according to DynDNS v2 protocol
-		// https://help.dyn.com/remote-access-api/return-codes/
-		// Note: For confirmation purposes, good and nochg messages will be followed by the IP address that the hostname was updated to.
-		// This value will be separated from the return code by a space.
-		switch status {
-		case "good", "nochg":
-			s.FinalStatus = status + " " + s.ResponseIp
-		default:
-			s.FinalStatus = status
+
+	credentialsJson := os.Getenv("CREDENTIALS")
+	if credentialsJson != "" {
+		err := json.Unmarshal([]byte(credentialsJson), &cfg.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CREDENTIALS: %v", err)
 		}
 	}
-}
-
-// endregion
 
-// region IPv6 Helper
-// combineIPv6 combines an IPv6 CIDR prefix with an interface ID.
-func combinePrefixAndIID6(network net.IPNet, ifaceIP net.IP) (string, error) {
-	//  Validate that the interface ID doesn't overlap with the prefix.
-	// We do this by masking the interface IP with the network mask.
-	// If the result is not '::', it means the interface ID has bits
-	// set in the prefix part, which is an invalid input.
-	maskedIfaceIP := ifaceIP.Mask(network.Mask)
-	if maskedIfaceIP.String() != "::" {
-		return "", fmt.Errorf("interface ID contains bits that overlap with the prefix")
+	// LOG_VERBOSE: "true" (case-insensitive) => true, else false
+	logVerboseEnv := strings.ToLower(os.Getenv("LOG_VERBOSE"))
+	cfg.LogVerbose = logVerboseEnv == "true"
+	if fileCfg.LogVerbose != nil {
+		cfg.LogVerbose = *fileCfg.LogVerbose
 	}
 
-	// Get the prefix length in bits and calculate the byte start index.
-	prefixLen, _ := network.Mask.Size()
-	startIndex := prefixLen / 8
+	// LOG_GROUP_BY_PROVIDER: "true" (case-insensitive) => true, else false
+	logGroupByProviderEnv := strings.ToLower(os.Getenv("LOG_GROUP_BY_PROVIDER"))
+	cfg.LogGroupByProvider = logGroupByProviderEnv == "true"
 
-	// Combine the two parts at the binary level.
-	finalIP := make(net.IP, net.IPv6len)
+	// TRUST_PROXY: "true" (case-insensitive) => the logged client IP is taken from X-Forwarded-For or X-Real-IP
+	trustProxyEnv := strings.ToLower(os.Getenv("TRUST_PROXY"))
+	cfg.TrustProxy = trustProxyEnv == "true"
 
-	// Copy the network prefix bytes.
-	copy(finalIP, network.IP)
+	// LOG_FORMAT: optional format of the log lines
+	cfg.LogFormat = strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT")))
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "text"
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return nil, fmt.Errorf("LOG_FORMAT must be text or json: %s", cfg.LogFormat)
+	}
 
-	// Bitwise OR the interface ID bytes with the final IP.
-	// This efficiently combines the two parts.
-	ifaceIP16 := ifaceIP.To16()
-	for i := startIndex; i < net.IPv6len; i++ {
-		finalIP[i] = finalIP[i] | ifaceIP16[i]
+	// LOG_LEVEL: optional minimum level of the log lines, verbose logging implies debug
+	cfg.LogLevel = strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL")))
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+		if cfg.LogVerbose {
+			cfg.LogLevel = "debug"
+		}
+	}
+	if _, ok := parseLogLevel(cfg.LogLevel); !ok {
+		return nil, fmt.Errorf("LOG_LEVEL must be error, warn, info or debug: %s", cfg.LogLevel)
 	}
 
-	return finalIP.String(), nil
-}
+	// LOG_MASK_DOMAIN: "true" (case-insensitive) => true, else false
+	logMaskDomainEnv := strings.ToLower(os.Getenv("LOG_MASK_DOMAIN"))
+	cfg.LogMaskDomain = logMaskDomainEnv == "true"
 
-// endregion
+	// DNS_SERVER: optional DNS server for resolving provider hostnames, e.g. "1.1.1.1" or "[2606:4700:4700::1111]:53"
+	cfg.DnsServer = strings.TrimSpace(os.Getenv("DNS_SERVER"))
+	if cfg.DnsServer != "" {
+		dnsServer, err := normalizeDnsServer(cfg.DnsServer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS_SERVER: %v", err)
+		}
+		cfg.DnsServer = dnsServer
+		cfg.Resolver = newResolver(dnsServer)
+		cfg.VerifyResolver = cfg.Resolver
+	}
 
-func dyndnsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("[REQUESTOR] " + r.RemoteAddr)
-	if globalErr != nil {
-		responseWithError(w, http.StatusInternalServerError, "911", "UNHEALTHY: config error. "+globalErr.Error())
-		return
+	// HTTP_TIMEOUT_MS: optional timeout of the provider requests
+	cfg.HttpTimeoutMs = 60000
+	if timeoutEnv := strings.TrimSpace(os.Getenv("HTTP_TIMEOUT_MS")); timeoutEnv != "" {
+		timeout, err := strconv.Atoi(timeoutEnv)
+		if err != nil || timeout < 1 {
+			return nil, fmt.Errorf("HTTP_TIMEOUT_MS must be a positive integer: %s", timeoutEnv)
+		}
+		cfg.HttpTimeoutMs = timeout
 	}
-	if config.LogVerbose {
-		log.Printf("[REQUESTOR] Full URL: %s\n", r.URL.String())
+	// MAX_RESPONSE_BYTES: optional limit of the provider response bodies that are read
+	cfg.MaxResponseBytes = defaultMaxResponseBytes
+	if maxResponseBytesEnv := strings.TrimSpace(os.Getenv("MAX_RESPONSE_BYTES")); maxResponseBytesEnv != "" {
+		maxResponseBytes, err := strconv.Atoi(maxResponseBytesEnv)
+		if err != nil || maxResponseBytes < 1 {
+			return nil, fmt.Errorf("MAX_RESPONSE_BYTES must be a positive integer: %s", maxResponseBytesEnv)
+		}
+		cfg.MaxResponseBytes = maxResponseBytes
 	}
-
-	query, err := ParseQueryParams(r)
-	if err != nil {
-		responseWithError(w, http.StatusBadRequest, "badauth", "[ERROR] "+err.Error())
-		return
-	} else if config.LogVerbose {
-		if query.Ip6LanNetwork != nil {
-			log.Printf("[REQUEST] Parsed Ip6LanNetwork: %s\n", query.Ip6LanNetwork.String())
+	// USER_AGENT: optional User-Agent of the provider requests, supports <useragent> like user_agent of a provider
+	cfg.UserAgent = defaultUserAgent()
+	if userAgentEnv := strings.TrimSpace(os.Getenv("USER_AGENT")); userAgentEnv != "" {
+		cfg.UserAgent = userAgentEnv
+	}
+	// CA_FILE: optional PEM bundle of the CAs that verify the providers, e.g. of a private CA, instead of the system CAs
+	cfg.CaFile = strings.TrimSpace(os.Getenv("CA_FILE"))
+	if cfg.CaFile != "" {
+		caPool, err := loadCaPool(cfg.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA_FILE: %v", err)
 		}
+		cfg.CaPool = caPool
+	}
+	// One client for all provider requests, so connections are reused.
+	// The timeout is set per request, as providers may override it with timeout_ms.
+	transport := newTransport(cfg.Resolver)
+	if cfg.CaPool != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.CaPool}
+	}
+	cfg.HttpClient = &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
 	}
 
-	// Check if query params match config
-	if (query.Username != config.Username) || (query.Password != config.Password) {
-		if config.LogVerbose {
-			if query.Username != config.Username {
-				log.Printf("query.Username=%s, expected=%s", query.Username, config.Username)
-			}
-			if query.Password != config.Password {
-				log.Printf("query.Password=%s, expected=%s", query.Password, config.Password)
-			}
+	// RESPONSE_DELAY_MS: optional delay before the response is written, after all providers are updated
+	if responseDelayEnv := strings.TrimSpace(os.Getenv("RESPONSE_DELAY_MS")); responseDelayEnv != "" {
+		responseDelay, err := strconv.Atoi(responseDelayEnv)
+		if err != nil || responseDelay < 0 {
+			return nil, fmt.Errorf("RESPONSE_DELAY_MS must be a non-negative integer: %s", responseDelayEnv)
 		}
-		responseWithError(w, http.StatusUnauthorized, "badauth", "[ERROR] Query parameters do not match configuration")
-		return
+		cfg.ResponseDelayMs = responseDelay
 	}
-	if query.Domain != config.Domain {
-		if config.LogVerbose {
-			if query.Domain != config.Domain {
-				log.Printf("query.Domain=%s, expected=%s", query.Domain, config.Domain)
-			}
+
+	// MAX_CONCURRENCY: optional maximum number of concurrent provider requests per /update, 0 = unlimited
+	if maxConcurrencyEnv := strings.TrimSpace(os.Getenv("MAX_CONCURRENCY")); maxConcurrencyEnv != "" {
+		maxConcurrency, err := strconv.Atoi(maxConcurrencyEnv)
+		if err != nil || maxConcurrency < 0 {
+			return nil, fmt.Errorf("MAX_CONCURRENCY must be a non-negative integer: %s", maxConcurrencyEnv)
 		}
-		responseWithError(w, http.StatusUnauthorized, "nohost", "[ERROR] Domain does not match configuration")
-		return
+		cfg.MaxConcurrency = maxConcurrency
 	}
 
-	tracker := NewStatusTracker(query.IpAddr, query.Ip6Addr)
-
-	for i, p := range config.Providers {
-		uri := p.Uri
-		uri = strings.ReplaceAll(uri, "<domain>", url.QueryEscape(p.Domain))
-		uri = strings.ReplaceAll(uri, "<ipaddr>", url.QueryEscape(query.IpAddr))
-		var ip6addr string
-		lazyWarning := ""
-		var lazyError error
-		lazyError = nil
-		if p.Iid6Masked != nil {
-			if query.Ip6LanNetwork == nil {
-				lazyWarning = "Provider requires IID6, but no ip6lanprefix was provided in the request. Using empty ip6addr for request."
-				ip6addr = ""
-			} else {
-				ip6addr, lazyError = combinePrefixAndIID6(*query.Ip6LanNetwork, p.Iid6Masked)
-				if config.LogVerbose && (ip6addr != "") && (lazyError != nil) {
-					log.Printf("[REQUEST] Parsed Ip6LanNetwork: %s\n", query.Ip6LanNetwork.String())
-				}
-			}
-		} else {
-			ip6addr = query.Ip6Addr
-		}
-		uri = strings.ReplaceAll(uri, "<ip6addr>", url.QueryEscape(ip6addr))
-		uri = strings.ReplaceAll(uri, "<ip6lanprefix>", url.QueryEscape(query.Ip6LanPrefix))
-		uri = strings.ReplaceAll(uri, "<dualstack>", url.QueryEscape(query.Dualstack))
-
-		loggingUri := uri
-		loggingUri = strings.ReplaceAll(loggingUri, "<username>", "*****")
-		loggingUri = strings.ReplaceAll(loggingUri, "<passwd>", "*****")
-		if lazyWarning != "" {
-			log.Printf("[WARNING] Index=%d URL=%s Warning=%s\n", i, loggingUri, lazyWarning)
-		}
-		log.Printf("[REQUEST] Index=%d URL=%s\n", i, loggingUri)
-		if lazyError != nil {
-			log.Printf("[ERROR] Index=%d URL=%s Error=%v\n", i, loggingUri, lazyError)
-			tracker.CheckStatus("911", true)
-			continue
+	// MAX_CONCURRENT_UPDATES: optional maximum number of concurrently handled /update requests, 0 = unlimited
+	if maxUpdatesEnv := strings.TrimSpace(os.Getenv("MAX_CONCURRENT_UPDATES")); maxUpdatesEnv != "" {
+		maxUpdates, err := strconv.Atoi(maxUpdatesEnv)
+		if err != nil || maxUpdates < 0 {
+			return nil, fmt.Errorf("MAX_CONCURRENT_UPDATES must be a non-negative integer: %s", maxUpdatesEnv)
 		}
+		cfg.MaxConcurrentUpdates = maxUpdates
+	}
+	cfg.ConcurrentUpdatesMode = strings.ToLower(strings.TrimSpace(os.Getenv("CONCURRENT_UPDATES_MODE")))
+	switch cfg.ConcurrentUpdatesMode {
+	case "":
+		cfg.ConcurrentUpdatesMode = "reject"
+	case "reject", "queue":
+	default:
+		return nil, fmt.Errorf("CONCURRENT_UPDATES_MODE must be reject or queue: %s", cfg.ConcurrentUpdatesMode)
+	}
+	// PROVIDER_STRATEGY: all (default) updates every provider, failover stops after the first successful provider
+	cfg.ProviderStrategy = strings.ToLower(strings.TrimSpace(os.Getenv("PROVIDER_STRATEGY")))
+	switch cfg.ProviderStrategy {
+	case "":
+		cfg.ProviderStrategy = "all"
+	case "all", "failover":
+	default:
+		return nil, fmt.Errorf("PROVIDER_STRATEGY must be all or failover: %s", cfg.ProviderStrategy)
+	}
 
-		// Optional delay before request
-		if p.DelayMs > 0 {
-			if config.LogVerbose {
-				log.Printf("[DELAY] Index=%d URL=%s, Waiting %d ms before request\n", i, loggingUri, p.DelayMs)
-			}
-			time.Sleep(time.Duration(p.DelayMs) * time.Millisecond)
+	// RATE_LIMIT_RPS and RATE_LIMIT_BURST: optional token bucket per client IP for /update, 0 = unlimited
+	if rateLimitEnv := strings.TrimSpace(os.Getenv("RATE_LIMIT_RPS")); rateLimitEnv != "" {
+		rateLimit, err := strconv.ParseFloat(rateLimitEnv, 64)
+		if err != nil || rateLimit < 0 || math.IsInf(rateLimit, 0) {
+			return nil, fmt.Errorf("RATE_LIMIT_RPS must be a non-negative number: %s", rateLimitEnv)
+		}
+		cfg.RateLimitRps = rateLimit
+	}
+	cfg.RateLimitBurst = max(1, int(math.Ceil(cfg.RateLimitRps)))
+	if burstEnv := strings.TrimSpace(os.Getenv("RATE_LIMIT_BURST")); burstEnv != "" {
+		burst, err := strconv.Atoi(burstEnv)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("RATE_LIMIT_BURST must be a positive integer: %s", burstEnv)
 		}
+		cfg.RateLimitBurst = burst
+	}
 
-		uri = strings.ReplaceAll(uri, "<username>", url.QueryEscape(p.Username))
-		uri = strings.ReplaceAll(uri, "<passwd>", url.QueryEscape(p.Password))
+	// SEVERITY_MAP: optional severities of nonstandard return codes, e.g. {"grace": 1, "waiting": 3}
+	severityMap, err := parseSeverityMap(os.Getenv("SEVERITY_MAP"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.SeverityMap = severityMap
 
-		// Make HTTP GET request with 60s timeout
-		httpClient := &http.Client{Timeout: 60 * time.Second}
-		resp, err := httpClient.Get(uri)
-		if err != nil {
-			log.Printf("[ERROR] Index=%d URL=%s Error=%v\n", i, loggingUri, err)
-			tracker.CheckStatus("911", true)
-			continue
+	// THROTTLE_STATUS: optional return code for requests that the server itself throttles, e.g. "nochg" or "abuse"
+	cfg.ThrottleStatus = strings.TrimSpace(os.Getenv("THROTTLE_STATUS"))
+	if cfg.ThrottleStatus == "" {
+		cfg.ThrottleStatus = "911"
+	} else if _, ok := cfg.SeverityMap[cfg.ThrottleStatus]; !ok {
+		return nil, fmt.Errorf("THROTTLE_STATUS must be a known return code, e.g. 911, abuse or nochg: %s", cfg.ThrottleStatus)
+	}
+	cfg.ConcurrentUpdatesQueueMs = 10000
+	if queueEnv := strings.TrimSpace(os.Getenv("CONCURRENT_UPDATES_QUEUE_TIMEOUT_MS")); queueEnv != "" {
+		queueMs, err := strconv.Atoi(queueEnv)
+		if err != nil || queueMs < 1 {
+			return nil, fmt.Errorf("CONCURRENT_UPDATES_QUEUE_TIMEOUT_MS must be a positive integer: %s", queueEnv)
 		}
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		cfg.ConcurrentUpdatesQueueMs = queueMs
+	}
 
-		if config.LogVerbose {
-			//log response headers
-			log.Printf("[RESPONSE-HEADERS] Index=%d URL=%s Status=%d Headers:", i, loggingUri, resp.StatusCode)
-			for k, v := range resp.Header {
-				log.Printf("    %s: %s", k, strings.Join(v, ", "))
-			}
-		}
+	// RESPONSE_IP6_MODE: how the IPv6 address is echoed in the "good <ip>"/"nochg <ip>" response line
+	cfg.ResponseIp6Mode = strings.ToLower(strings.TrimSpace(os.Getenv("RESPONSE_IP6_MODE")))
+	switch cfg.ResponseIp6Mode {
+	case "":
+		cfg.ResponseIp6Mode = "full"
+	case "full", "mask", "omit":
+	default:
+		return nil, fmt.Errorf("RESPONSE_IP6_MODE must be full, mask or omit: %s", cfg.ResponseIp6Mode)
+	}
 
-		var result string
-		exactReturnCodeMatch := false
-		// 1. check for exact return code match in header DDNSS-Response
-		// Extended evaluation: Header "DDNSS-Response" and "DDNSS-Message"
-		if result = resp.Header.Get("DDNSS-Response"); result != "" {
-			exactReturnCodeMatch = true
-			log.Printf("[RESPONSE] Index=%d URL=%s Status=%d DDNSS-Response=%s\n", i, loggingUri, resp.StatusCode, result)
-			ddnssMessage := resp.Header.Get("DDNSS-Message")
-			if ddnssMessage != "" {
-				log.Printf("[DDNSS-Message] Index=%d Message=%s\n", i, ddnssMessage)
-			}
-		} else {
-			// 2. Check if a severity attribute exists as a header
-			severityFound := ""
-			for sev := range tracker.SeverityMap {
-				if val := resp.Header.Get(sev); val != "" {
-					exactReturnCodeMatch = true
-					severityFound = sev
-					result = sev
-					log.Printf("[RESPONSE] Index=%d URL=%s Status=%d SeverityHeader=%s\n", i, loggingUri, resp.StatusCode, sev)
-					break
-				}
-			}
-			if severityFound == "" {
-				//3. Fallback to body content
-				result = string(body)
-				log.Printf("[RESPONSE] Index=%d URL=%s Status=%d Body=%s\n", i, loggingUri, resp.StatusCode, result)
-			}
-		}
+	// STRICT_HTTP_STATUS: "true" (case-insensitive) => the HTTP status of /update reflects the aggregated return code
+	strictHttpStatusEnv := strings.ToLower(os.Getenv("STRICT_HTTP_STATUS"))
+	cfg.StrictHttpStatus = strictHttpStatusEnv == "true"
 
-		tracker.CheckStatus(result, exactReturnCodeMatch)
+	// FORWARD_HEADERS: optional comma separated allowlist of client request headers to forward to the providers
+	for _, name := range strings.Split(os.Getenv("FORWARD_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cfg.ForwardHeaders = append(cfg.ForwardHeaders, name)
+		}
+	}
+	if err := validateForwardHeaders(cfg.ForwardHeaders); err != nil {
+		return nil, fmt.Errorf("invalid FORWARD_HEADERS: %v", err)
 	}
 
-	w.Header().Set(tracker.HeaderStatus, tracker.FinalStatus)
-	fmt.Fprintln(w, tracker.FinalStatus)
+	// VERIFY_DNS_*: settings for the DNS verification of providers with "verify_dns": true
+	cfg.VerifyDnsServer = strings.TrimSpace(os.Getenv("VERIFY_DNS_SERVER"))
+	if cfg.VerifyDnsServer != "" {
+		verifyDnsServer, err := normalizeDnsServer(cfg.VerifyDnsServer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VERIFY_DNS_SERVER: %v", err)
+		}
+		cfg.VerifyDnsServer = verifyDnsServer
+		cfg.VerifyResolver = newResolver(verifyDnsServer)
+	}
+	cfg.VerifyDnsRetries = 3
+	if retriesEnv := strings.TrimSpace(os.Getenv("VERIFY_DNS_RETRIES")); retriesEnv != "" {
+		retries, err := strconv.Atoi(retriesEnv)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("VERIFY_DNS_RETRIES must be a non-negative integer: %s", retriesEnv)
+		}
+		cfg.VerifyDnsRetries = retries
+	}
+	cfg.VerifyDnsTimeoutMs = 2000
+	if timeoutEnv := strings.TrimSpace(os.Getenv("VERIFY_DNS_TIMEOUT_MS")); timeoutEnv != "" {
+		timeout, err := strconv.Atoi(timeoutEnv)
+		if err != nil || timeout < 1 {
+			return nil, fmt.Errorf("VERIFY_DNS_TIMEOUT_MS must be a positive integer: %s", timeoutEnv)
+		}
+		cfg.VerifyDnsTimeoutMs = timeout
+	}
+
+	// HEALTH_CHECK_TIMEOUT_MS: optional timeout of the deep health check, all providers are probed within it
+	cfg.HealthCheckTimeoutMs = 5000
+	if timeoutEnv := strings.TrimSpace(os.Getenv("HEALTH_CHECK_TIMEOUT_MS")); timeoutEnv != "" {
+		timeout, err := strconv.Atoi(timeoutEnv)
+		if err != nil || timeout < 1 {
+			return nil, fmt.Errorf("HEALTH_CHECK_TIMEOUT_MS must be a positive integer: %s", timeoutEnv)
+		}
+		cfg.HealthCheckTimeoutMs = timeout
+	}
+
+	// SUCCESS_CONDITION: optional condition over the provider results, e.g. "failed == 0" or "good >= 1"
+	cfg.SuccessCondition = strings.TrimSpace(os.Getenv("SUCCESS_CONDITION"))
+	if cfg.SuccessCondition != "" {
+		names := []string{"total", "succeeded", "failed", "timeout"}
+		for code := range cfg.SeverityMap {
+			names = append(names, code)
+		}
+		sort.Strings(names[4:])
+		condition, err := ParseSuccessCondition(cfg.SuccessCondition, names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SUCCESS_CONDITION: %v", err)
+		}
+		cfg.SuccessConditionExpr = condition
+	}
+
+	cfg.AdminUsername = os.Getenv("ADMIN_USER_NAME")
+	if cfg.AdminUsername == "" {
+		cfg.AdminUsername = "admin"
+	}
+	adminPassword, err := secretFromEnv("ADMIN_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	cfg.AdminPassword = adminPassword
+
+	// COUNTERS_FILE: optional file to persist the counters across restarts
+	cfg.CountersFile = strings.TrimSpace(os.Getenv("COUNTERS_FILE"))
+
+	// LAST_RESULT_FILE: optional JSON file with the result of the last /update request
+	cfg.LastResultFile = strings.TrimSpace(os.Getenv("LAST_RESULT_FILE"))
+	cfg.CountersPersistIntervalS = 300
+	if intervalEnv := strings.TrimSpace(os.Getenv("COUNTERS_PERSIST_INTERVAL_S")); intervalEnv != "" {
+		interval, err := strconv.Atoi(intervalEnv)
+		if err != nil || interval < 1 {
+			return nil, fmt.Errorf("COUNTERS_PERSIST_INTERVAL_S must be a positive integer: %s", intervalEnv)
+		}
+		cfg.CountersPersistIntervalS = interval
+	}
+
+	// IP_CACHE_TTL_S: optional seconds during which an unchanged IP is not sent to a provider again, 0 = disabled
+	if ipCacheTtlEnv := strings.TrimSpace(os.Getenv("IP_CACHE_TTL_S")); ipCacheTtlEnv != "" {
+		ipCacheTtl, err := strconv.Atoi(ipCacheTtlEnv)
+		if err != nil || ipCacheTtl < 0 {
+			return nil, fmt.Errorf("IP_CACHE_TTL_S must be a non-negative integer: %s", ipCacheTtlEnv)
+		}
+		cfg.IpCacheTtlS = ipCacheTtl
+	}
+	// STATE_FILE: optional JSON file to persist the IP cache across restarts
+	cfg.StateFile = strings.TrimSpace(os.Getenv("STATE_FILE"))
+
+	// OTEL_ENABLED: "true" (case-insensitive) => true, else false
+	otelEnabledEnv := strings.ToLower(os.Getenv("OTEL_ENABLED"))
+	cfg.OtelEnabled = otelEnabledEnv == "true"
+
+	// MAX_PARAM_LENGTH: optional maximum length of each query param value
+	cfg.MaxParamLength = defaultMaxParamLength
+	if maxParamLengthEnv := strings.TrimSpace(os.Getenv("MAX_PARAM_LENGTH")); maxParamLengthEnv != "" {
+		maxParamLength, err := strconv.Atoi(maxParamLengthEnv)
+		if err != nil || maxParamLength < 1 {
+			return nil, fmt.Errorf("MAX_PARAM_LENGTH must be a positive integer: %s", maxParamLengthEnv)
+		}
+		cfg.MaxParamLength = maxParamLength
+	}
+
+	// ALLOW_NO_PROVIDERS: "true" (case-insensitive) => true, else false
+	allowNoProvidersEnv := strings.ToLower(os.Getenv("ALLOW_NO_PROVIDERS"))
+	cfg.AllowNoProviders = allowNoProvidersEnv == "true"
+
+	// ALLOW_MISSING_ENV: "true" (case-insensitive) => unset variables in <env:VAR> are empty, else a config error
+	allowMissingEnvEnv := strings.ToLower(os.Getenv("ALLOW_MISSING_ENV"))
+	cfg.AllowMissingEnv = allowMissingEnvEnv == "true"
+
+	if len(cfg.Providers) == 0 {
+		if !cfg.AllowNoProviders {
+			return nil, fmt.Errorf("no provider defined (PROVIDERS is empty or missing)")
+		}
+		log.Println("[WARNING] No provider defined (PROVIDERS is empty or missing), /update will not update any provider")
+	}
+	// PASSTHROUGH: "true" (case-insensitive) => the response of the only provider is returned unchanged, else false
+	passthroughEnv := strings.ToLower(os.Getenv("PASSTHROUGH"))
+	cfg.Passthrough = passthroughEnv == "true"
+	if cfg.Passthrough {
+		// Domains and macs count as the providers they are expanded into
+		count := 0
+		for _, p := range cfg.Providers {
+			count += expandedCount(p)
+		}
+		if count != 1 {
+			return nil, fmt.Errorf("PASSTHROUGH requires exactly one provider, but %d are defined (use passthrough of a provider instead)", count)
+		}
+		cfg.Providers[0].Passthrough = true
+	}
+	// Providers are validated before domains and macs are expanded, so errors report the index in PROVIDERS
+	passthroughIndex := -1
+	for i, p := range cfg.Providers {
+		if strings.TrimSpace(p.Uri) == "" {
+			return nil, fmt.Errorf("provider at index %d is missing a URI", i)
+		} else {
+			if len(p.Params) > 0 {
+				// Append the renamed params to the URI, so they are substituted like placeholders
+				uri, err := appendParams(p.Uri, p.Params)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has invalid params: %v", i, err)
+				}
+				p.Uri = uri
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.PasswordFile != "" {
+				// Read the passwd from a secret file
+				if p.Password != "" || p.Credentials != "" {
+					return nil, fmt.Errorf("provider at index %d must not define passwd_file together with passwd or credentials", i)
+				}
+				password, err := readSecretFile(p.PasswordFile)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid passwd_file: %v", i, err)
+				}
+				p.Password = password
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.Credentials != "" {
+				// Resolve the named credential set into username and passwd
+				credential, ok := cfg.Credentials[p.Credentials]
+				if !ok {
+					return nil, fmt.Errorf("provider at index %d references unknown credentials: %s", i, p.Credentials)
+				}
+				if p.Username != "" || p.Password != "" {
+					return nil, fmt.Errorf("provider at index %d must not define username/passwd together with credentials", i)
+				}
+				p.Username = credential.Username
+				p.Password = credential.Password
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.Iid6 != "" {
+				//Parse and validate the interface ID.
+				ifaceIP, err := parseIid6(p.Iid6)
+				if err != nil {
+					return nil, err
+				} else {
+					p.Iid6Masked = ifaceIP
+					cfg.Providers[i] = p // Update the slice with the modified provider
+
+					logVerbosef(cfg, "Provider[%d]: Parsed IID6 %s to %s\n", i, p.Iid6, p.Iid6Masked.String())
+				}
+			}
+			if envValues, err := resolveEnvPlaceholders(p, cfg.AllowMissingEnv); err != nil {
+				return nil, fmt.Errorf("provider at index %d %v", i, err)
+			} else if len(envValues) > 0 {
+				p.EnvValues = envValues
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.Iid4 != "" {
+				// Parse and validate the IPv4 host part
+				ifaceIP, err := parseIid4(p.Iid4)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid iid4: %v", i, err)
+				}
+				p.Iid4Masked = ifaceIP
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			for _, token := range p.FailWhenContains {
+				if token == "" {
+					return nil, fmt.Errorf("provider at index %d has an empty token in fail_when_contains", i)
+				}
+			}
+			if p.SuccessRegex != "" {
+				successRegex, err := regexp.Compile(p.SuccessRegex)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid success_regex: %v", i, err)
+				}
+				p.SuccessRegexParsed = successRegex
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.FailureRegex != "" {
+				failureRegex, err := regexp.Compile(p.FailureRegex)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid failure_regex: %v", i, err)
+				}
+				p.FailureRegexParsed = failureRegex
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.TimeoutMs < 0 {
+				return nil, fmt.Errorf("provider at index %d has a negative timeout_ms", i)
+			}
+			if p.MinUpdateIntervalS < 0 {
+				return nil, fmt.Errorf("provider at index %d has a negative min_update_interval_s", i)
+			}
+			if err := validateForwardHeaders(p.ForwardHeaders); err != nil {
+				return nil, fmt.Errorf("provider at index %d has invalid forward_headers: %v", i, err)
+			}
+			if p.VerifyDns && p.Domain == "" && len(p.Domains) == 0 {
+				return nil, fmt.Errorf("provider at index %d has verify_dns enabled, but no domain", i)
+			}
+			if p.DefaultCode != "" {
+				if _, ok := cfg.SeverityMap[p.DefaultCode]; !ok {
+					return nil, fmt.Errorf("provider at index %d has an unknown default_code: %s", i, p.DefaultCode)
+				}
+			}
+			if p.Method != "" {
+				p.Method = strings.ToUpper(p.Method)
+				if !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch}, p.Method) {
+					return nil, fmt.Errorf("provider at index %d has an unsupported method: %s (allowed: GET, POST, PUT, PATCH)", i, p.Method)
+				}
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.Body != "" && (p.Method == "" || p.Method == http.MethodGet) {
+				return nil, fmt.Errorf("provider at index %d has a body, but method %s doesn't send one (use POST, PUT or PATCH)", i, http.MethodGet)
+			}
+			if p.RequireStatus != 0 && (p.RequireStatus < 100 || p.RequireStatus > 599) {
+				return nil, fmt.Errorf("provider at index %d has an invalid require_status: %d (must be between 100 and 599)", i, p.RequireStatus)
+			}
+			if p.Retries < 0 || p.RetryBackoffMs < 0 {
+				return nil, fmt.Errorf("provider at index %d has a negative retries or retry_backoff_ms", i)
+			}
+			for _, code := range p.RetryOn {
+				if _, ok := cfg.SeverityMap[code]; !ok {
+					return nil, fmt.Errorf("provider at index %d has an unknown return code in retry_on: %s", i, code)
+				}
+			}
+			switch p.Auth {
+			case "", "query":
+			case "basic":
+				if strings.Contains(p.Uri, "<username>") || strings.Contains(p.Uri, "<passwd>") {
+					return nil, fmt.Errorf("provider at index %d uses auth basic, but uri contains <username> or <passwd>", i)
+				}
+			default:
+				return nil, fmt.Errorf("provider at index %d has an invalid auth: %s (allowed: query, basic)", i, p.Auth)
+			}
+			if p.TlsServerName != "" && !isValidServerName(p.TlsServerName) {
+				return nil, fmt.Errorf("provider at index %d has an invalid tls_server_name: %s", i, p.TlsServerName)
+			}
+			if (p.ClientCertFile == "") != (p.ClientKeyFile == "") {
+				return nil, fmt.Errorf("provider at index %d must set client_cert_file and client_key_file together", i)
+			}
+			if p.InsecureSkipVerify && p.CaFile != "" {
+				return nil, fmt.Errorf("provider at index %d must not combine insecure_skip_verify with ca_file", i)
+			}
+			if hasTlsOptions(p) {
+				client, err := newProviderClient(cfg, p)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d %v", i, err)
+				}
+				p.HttpClient = client
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.InsecureSkipVerify {
+				log.Printf("[WARNING] Provider at index %d has insecure_skip_verify, its TLS certificate is NOT verified and its requests, including credentials, can be intercepted\n", i)
+			}
+			if p.Passthrough {
+				if passthroughIndex >= 0 {
+					return nil, fmt.Errorf("provider at index %d has passthrough, but provider at index %d has it already", i, passthroughIndex)
+				}
+				if count := expandedCount(p); count > 1 {
+					return nil, fmt.Errorf("provider at index %d has passthrough, but is expanded into %d providers by domains or macs", i, count)
+				}
+				passthroughIndex = i
+			}
+			if p.HealthCheckUrl != "" {
+				if err := validateHealthCheckUrl(p.HealthCheckUrl); err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid health_check_url: %v", i, err)
+				}
+				p.HealthCheck = true
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			switch p.Family {
+			case "", "any", "ipv4", "ipv6":
+			default:
+				return nil, fmt.Errorf("provider at index %d has an invalid family: %s (allowed: any, ipv4, ipv6)", i, p.Family)
+			}
+			if p.ResponseIpSource != "" && p.ResponseIpSource != "request" && p.ResponseIpSource != "body" {
+				return nil, fmt.Errorf("provider at index %d has an invalid response_ip_source: %s (allowed: request, body)", i, p.ResponseIpSource)
+			}
+			if p.ActiveWindow != "" {
+				window, err := ParseActiveWindow(p.ActiveWindow)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid active_window: %v", i, err)
+				}
+				p.ActiveWindowParsed = window
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+			if p.When != "" {
+				conditions, err := ParseWhenConditions(p.When)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid when condition: %v", i, err)
+				}
+				p.WhenConditions = conditions
+				cfg.Providers[i] = p // Update the slice with the modified provider
+			}
+		}
+	}
+	providers, err := expandProviders(cfg.Providers)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Providers = providers
+
+	// DUPLICATE_PROVIDERS: warn (default) or error if providers would send identical requests, e.g. after a copy-paste mistake
+	cfg.DuplicateProviders = strings.ToLower(strings.TrimSpace(os.Getenv("DUPLICATE_PROVIDERS")))
+	switch cfg.DuplicateProviders {
+	case "":
+		cfg.DuplicateProviders = "warn"
+	case "warn", "error":
+	default:
+		return nil, fmt.Errorf("DUPLICATE_PROVIDERS must be warn or error: %s", cfg.DuplicateProviders)
+	}
+	for _, duplicate := range findDuplicateProviders(cfg.Providers) {
+		first, second := providerIndexLabel(cfg, cfg.Providers[duplicate[0]]), providerIndexLabel(cfg, cfg.Providers[duplicate[1]])
+		if cfg.DuplicateProviders == "error" {
+			return nil, fmt.Errorf("provider at index %s is a duplicate of provider at index %s (same uri, method, body, credentials, domain, interface IDs and when)", second, first)
+		}
+		log.Printf("[WARNING] Provider at index %s is a duplicate of provider at index %s (same uri, method, body, credentials, domain, interface IDs and when), it is updated twice\n", second, first)
+	}
+	// Disabled providers are validated like the others, and a list of disabled providers is not "no providers"
+	if len(cfg.Providers) > 0 && !slices.ContainsFunc(cfg.Providers, Provider.IsEnabled) {
+		log.Println("[WARNING] All providers are disabled, /update will not update any provider")
+	}
+	return cfg, nil
+}
+
+// Returns the index pairs of providers that send identical requests, each duplicate with the index of its first occurrence.
+// Providers are compared after params, passwd_file and credentials are resolved.
+func findDuplicateProviders(providers []Provider) [][2]int {
+	type providerKey struct {
+		Method, Uri, Body, Username, Password, Domain, Iid6, Iid4, When string
+	}
+	first := map[providerKey]int{}
+	var duplicates [][2]int
+	for i, p := range providers {
+		if !p.IsEnabled() {
+			continue
+		}
+		key := providerKey{
+			Method:   cmp.Or(p.Method, http.MethodGet),
+			Uri:      strings.TrimSpace(p.Uri),
+			Body:     p.Body,
+			Username: p.Username,
+			Password: p.Password,
+			Domain:   p.Domain,
+			Iid6:     p.Iid6,
+			Iid4:     p.Iid4,
+			When:     strings.TrimSpace(p.When),
+		}
+		if p.Iid6Masked != nil {
+			key.Iid6 = p.Iid6Masked.String()
+		}
+		if p.Iid4Masked != nil {
+			key.Iid4 = p.Iid4Masked.String()
+		}
+		if index, ok := first[key]; ok {
+			duplicates = append(duplicates, [2]int{index, i})
+			continue
+		}
+		first[key] = i
+	}
+	return duplicates
+}
+
+// region DNS Resolver
+// Validates the DNS server address and adds the default port 53 if missing
+func normalizeDnsServer(server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		// no port given, e.g. "1.1.1.1" or "2606:4700:4700::1111"
+		host, port = strings.Trim(server, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%s is not an IP address", host)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("%s is not a valid port", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Creates a resolver that sends all DNS queries to the given server
+func newResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 10 * time.Second}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Returns true if the provider has TLS options that require its own client
+func hasTlsOptions(p Provider) bool {
+	return p.TlsServerName != "" || p.ClientCertFile != "" || p.CaFile != "" || p.InsecureSkipVerify
+}
+
+// Returns a client with its own transport for a provider with TLS options, so the options don't affect
+// other providers and connections aren't shared with them. The certificate files are read once, a reload reads them again.
+func newProviderClient(cfg *Config, p Provider) (*http.Client, error) {
+	tlsConfig := &tls.Config{ServerName: p.TlsServerName, RootCAs: cfg.CaPool, InsecureSkipVerify: p.InsecureSkipVerify}
+	if p.ClientCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(p.ClientCertFile, p.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid client_cert_file or client_key_file: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if p.CaFile != "" {
+		pool, err := loadCaPool(p.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := newTransport(cfg.Resolver)
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// Reads a PEM bundle of CA certificates, e.g. of a private CA
+func loadCaPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// Returns true if name is a valid DNS name for SNI (IP addresses aren't sent as SNI)
+func isValidServerName(name string) bool {
+	if len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Creates a transport based on http.DefaultTransport with connection pooling tuned for repeated requests to few provider hosts.
+// Hostnames are resolved with the given resolver, or the system resolver if nil.
+func newTransport(resolver *net.Resolver) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 10
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// endregion
+
+// region ActiveWindow
+// Time-of-day range in which a provider is updated. The range may wrap around midnight, e.g. 22:00-06:00
+type ActiveWindow struct {
+	Start    int // minutes since midnight, inclusive
+	End      int // minutes since midnight, exclusive
+	Location *time.Location
+}
+
+// Parses "HH:MM-HH:MM" with an optional IANA timezone separated by a space, e.g. "22:00-06:00 Europe/Berlin".
+// Without a timezone, the local time of the container is used.
+func ParseActiveWindow(window string) (*ActiveWindow, error) {
+	fields := strings.Fields(window)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("expected \"HH:MM-HH:MM [timezone]\", got %q", window)
+	}
+	startText, endText, found := strings.Cut(fields[0], "-")
+	if !found {
+		return nil, fmt.Errorf("expected \"HH:MM-HH:MM [timezone]\", got %q", window)
+	}
+	aw := &ActiveWindow{Location: time.Local}
+	var err error
+	if aw.Start, err = parseTimeOfDay(startText); err != nil {
+		return nil, err
+	}
+	if aw.End, err = parseTimeOfDay(endText); err != nil {
+		return nil, err
+	}
+	if aw.Start == aw.End {
+		return nil, fmt.Errorf("start and end of %q are equal", window)
+	}
+	if len(fields) == 2 {
+		if aw.Location, err = time.LoadLocation(fields[1]); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q: %v", fields[1], err)
+		}
+	}
+	return aw, nil
+}
+
+// Parses "HH:MM" into minutes since midnight
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Returns true if the time is within the window
+func (aw *ActiveWindow) Contains(t time.Time) bool {
+	t = t.In(aw.Location)
+	minutes := t.Hour()*60 + t.Minute()
+	if aw.Start < aw.End {
+		return minutes >= aw.Start && minutes < aw.End
+	}
+	// wraps around midnight
+	return minutes >= aw.Start || minutes < aw.End
+}
+
+// endregion
+
+// region DNS Verification
+// Looks up the domain and checks that every expected address is returned.
+// Lookups are retried with exponential backoff (1s, 2s, 4s, ...) to allow for propagation.
+// Returns "verified", "mismatch" (the domain resolves to other addresses) or "failed" (lookup error).
+func verifyDns(ctx context.Context, config *Config, domain string, expected []string, plog *ProviderLog) string {
+	resolver := config.VerifyResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	result := "failed"
+	for attempt := 0; attempt <= config.VerifyDnsRetries; attempt++ {
+		if attempt > 0 {
+			// A disconnected client doesn't wait for the backoff, so its update slot is freed
+			select {
+			case <-clock.After(time.Duration(1<<(attempt-1)) * time.Second):
+			case <-ctx.Done():
+				return result
+			}
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(config.VerifyDnsTimeoutMs)*time.Millisecond)
+		addrs, err := resolver.LookupIPAddr(lookupCtx, domain)
+		cancel()
+		if err != nil {
+			result = "failed"
+			plog.Verbosef("[VERIFY] Domain=%s Attempt=%d Error=%v\n", logDomain(config, domain), attempt, err)
+			continue
+		}
+		if containsAllAddresses(addrs, expected) {
+			return "verified"
+		}
+		result = "mismatch"
+		plog.Verbosef("[VERIFY] Domain=%s Attempt=%d Addresses=%v\n", logDomain(config, domain), attempt, addrs)
+	}
+	return result
+}
+
+// Returns true if every non-empty expected address is contained in addrs
+func containsAllAddresses(addrs []net.IPAddr, expected []string) bool {
+	for _, e := range expected {
+		if e == "" {
+			continue
+		}
+		expectedIP := net.ParseIP(e)
+		found := false
+		for _, a := range addrs {
+			if expectedIP != nil && a.IP.Equal(expectedIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// endregion
+
+// region WhenCondition
+// A single condition on a request parameter, parsed from the provider attribute "when"
+type WhenCondition struct {
+	Param    string // name of the query param, e.g. "dualstack"
+	Operator string // "present", "absent", "==" or "!="
+	Value    string // compared value for "==" and "!="
+}
+
+// Query params that can be referenced in a when condition
+var whenParams = []string{"domain", "ipaddr", "ip6addr", "ip4lanprefix", "ip6lanprefix", "dualstack", "system", "offline"}
+
+// Parses conditions joined by "&&". Supported forms: "param", "!param", "param==value", "param!=value"
+func ParseWhenConditions(when string) ([]WhenCondition, error) {
+	var conditions []WhenCondition
+	for _, part := range strings.Split(when, "&&") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("empty condition in %q", when)
+		}
+		c := WhenCondition{}
+		if param, value, found := strings.Cut(part, "!="); found {
+			c.Param, c.Operator, c.Value = param, "!=", value
+		} else if param, value, found := strings.Cut(part, "=="); found {
+			c.Param, c.Operator, c.Value = param, "==", value
+		} else if strings.HasPrefix(part, "!") {
+			c.Param, c.Operator = part[1:], "absent"
+		} else {
+			c.Param, c.Operator = part, "present"
+		}
+		c.Param = strings.TrimSpace(c.Param)
+		c.Value = strings.TrimSpace(c.Value)
+		known := false
+		for _, name := range whenParams {
+			if c.Param == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown query param %q in condition %q (allowed: %s)", c.Param, part, strings.Join(whenParams, ", "))
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+// Returns true if all conditions are met by the query params
+func MatchWhenConditions(conditions []WhenCondition, query *QueryParams) bool {
+	for _, c := range conditions {
+		value := query.Get(c.Param)
+		switch c.Operator {
+		case "present":
+			if value == "" {
+				return false
+			}
+		case "absent":
+			if value != "" {
+				return false
+			}
+		case "==":
+			if value != c.Value {
+				return false
+			}
+		case "!=":
+			if value == c.Value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// endregion
+
+// endregion
+
+// region main
+// Loaded config and config error. They are swapped together on a reload (SIGHUP), while requests read them concurrently.
+type configState struct {
+	config *Config
+	err    error
+}
+
+var loadedConfig atomic.Pointer[configState]
+
+// Returns the current config, nil if no valid config was loaded
+func currentConfig() *Config {
+	if state := loadedConfig.Load(); state != nil {
+		return state.config
+	}
+	return nil
+}
+
+// Returns the error of the config, nil if the current config is valid
+func currentConfigError() error {
+	if state := loadedConfig.Load(); state != nil {
+		return state.err
+	}
+	return nil
+}
+
+func main() {
+	// Applied before the config is loaded, so all log lines have the same format, and again with the loaded config
+	setupLogging(os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	config, err := LoadConfigFromEnv()
+	loadedConfig.Store(&configState{config: config, err: err})
+	if err == nil {
+		setupLogging(config.LogFormat, config.LogLevel)
+	}
+	registerMetrics()
+	if err != nil {
+		log.Printf("[ERROR] Config error: %v", err)
+	} else {
+		logConfig(config)
+		if config.OtelEnabled {
+			shutdown, err := setupTracing(context.Background())
+			if err != nil {
+				log.Printf("[ERROR] Tracing error: %v", err)
+			} else {
+				defer shutdown(context.Background())
+				log.Println("OpenTelemetry tracing enabled")
+			}
+		}
+
+		if config.MaxConcurrentUpdates > 0 {
+			updateSlots = make(chan struct{}, config.MaxConcurrentUpdates)
+		}
+		if config.CountersFile != "" {
+			counters.Load(config.CountersFile)
+			go counters.PersistPeriodically(config.CountersFile, time.Duration(config.CountersPersistIntervalS)*time.Second)
+		}
+		if config.StateFile != "" {
+			ipCache.Load(config.StateFile)
+		}
+	}
+	// Also started without RATE_LIMIT_RPS, as a reload may enable it
+	go rateLimiter.CleanupPeriodically(rateLimiterCleanupInterval)
+
+	// The paths of the update and health endpoints are configurable; a reload doesn't change them
+	updatePath, healthPath := defaultUpdatePath, defaultHealthPath
+	if config != nil {
+		updatePath, healthPath = config.UpdatePath, config.HealthPath
+	}
+
+	// All handlers are wrapped by withRecover, a panic only fails its own request
+	http.HandleFunc(healthPath, withRecover(healthEndpoint))
+	http.HandleFunc("/ready", withRecover(readyEndpoint))
+	http.HandleFunc("/status", withRecover(statusEndpoint))
+	http.HandleFunc("/version", withRecover(versionEndpoint))
+	http.HandleFunc("/metrics", withRecover(promhttp.Handler().ServeHTTP))
+	http.HandleFunc(updatePath, withRecover(withRateLimit(withUpdateLimit(dyndnsHandler))))
+	http.HandleFunc("/combine", withRecover(withAdminAuth(combineEndpoint)))
+	http.HandleFunc("/placeholders", withRecover(withAdminAuth(placeholdersEndpoint)))
+	http.HandleFunc("/inflight", withRecover(withAdminAuth(inFlightEndpoint)))
+
+	// Without a valid config, the server still starts on the default port, so /ready and /update report the config error
+	listenAddr := net.JoinHostPort("", strconv.Itoa(defaultListenPort))
+	shutdownTimeout := defaultShutdownTimeoutMs * time.Millisecond
+	if config != nil {
+		listenAddr = config.ListenAddr()
+		shutdownTimeout = time.Duration(config.ShutdownTimeoutMs) * time.Millisecond
+	}
+	server := &http.Server{Addr: listenAddr}
+	useTls := config != nil && config.TlsEnabled()
+	scheme := "http"
+	if useTls {
+		server.TLSConfig = &tls.Config{MinVersion: config.TlsMinVersion}
+		scheme = "https"
+	}
+	stopped := make(chan struct{})
+	go func() {
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		for range reloads {
+			reloadConfig()
+		}
+	}()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down\n", sig)
+		shutdownServer(server, shutdownTimeout)
+		close(stopped)
+	}()
+
+	log.Printf("app started on %s (%s), update path %s, health path %s\n", listenAddr, scheme, updatePath, healthPath)
+	if useTls {
+		err = server.ListenAndServeTLS(config.TlsCertFile, config.TlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+	if config := currentConfig(); config != nil && config.CountersFile != "" {
+		// Persist the counters on shutdown
+		counters.Save(config.CountersFile)
+	}
+}
+
+// Logs the settings of a loaded config, the provider attributes without username and password
+func logConfig(config *Config) {
+	if config.LogVerbose {
+		log.Println("Verbose logging enabled. WARNING: This may expose sensitive information in logs. Use it with caution.")
+	} else {
+		log.Println("Verbose logging disabled")
+	}
+	if config.DnsServer != "" {
+		log.Printf("Using DNS server %s for provider requests\n", config.DnsServer)
+	}
+	if config.SuccessCondition != "" {
+		log.Printf("Using success condition: %s\n", config.SuccessCondition)
+	}
+
+	for i, p := range config.Providers {
+		var iid6Parsed string
+		if p.Iid6Masked != nil {
+			iid6Parsed = p.Iid6Masked.String()
+		} else {
+			iid6Parsed = ""
+		}
+
+		var iid4Parsed string
+		if p.Iid4Masked != nil {
+			iid4Parsed = p.Iid4Masked.String()
+		}
+
+		// Copies expanded from domains or macs are logged with their index in PROVIDERS, the index in the update logs is appended
+		label := providerIndexLabel(config, p)
+		if label != strconv.Itoa(i) {
+			label = fmt.Sprintf("%s, index=%d", label, i)
+		}
+		log.Printf("Provider[%s]: uri=%s, domain=%s, iid6=%s, iid4=%s, delay_ms=%d, when=%s, enabled=%t", label, logDomainsIn(config, p.Uri, p.Domain, config.Domain), logDomain(config, p.Domain), iid6Parsed, iid4Parsed, p.DelayMs, p.When, p.IsEnabled())
+	}
+}
+
+// Reloads the config from the environment and CONFIG_FILE (SIGHUP). The config is loaded once per request and passed down,
+// so in-flight updates keep the config they started with.
+// If the new config is invalid, the current config stays active; the error is only reported if there is no valid config yet.
+// The listen address, TLS, UPDATE_PATH, HEALTH_PATH, MAX_CONCURRENT_UPDATES, COUNTERS_FILE, OTEL_ENABLED and SHUTDOWN_TIMEOUT_MS require a restart.
+func reloadConfig() {
+	log.Println("Received SIGHUP, reloading the config")
+	config, err := LoadConfigFromEnv()
+	if err != nil {
+		if currentConfig() != nil {
+			log.Printf("[ERROR] Config reload failed, keeping the current config: %v", err)
+			return
+		}
+		loadedConfig.Store(&configState{err: err})
+		log.Printf("[ERROR] Config error: %v", err)
+		return
+	}
+	loadedConfig.Store(&configState{config: config})
+	// The provider indexes may belong to other providers now
+	updatePacing.Reset()
+	lastRequests.Reset()
+	updateStatus.ResetProviders()
+	ipCache.Reset()
+	// The limiters are created with the current RATE_LIMIT_RPS and RATE_LIMIT_BURST
+	rateLimiter.Reset()
+	setupLogging(config.LogFormat, config.LogLevel)
+	log.Println("Config reloaded")
+	logConfig(config)
+}
+
+// Default grace period for in-flight requests on shutdown
+const defaultShutdownTimeoutMs = 5000
+
+// Stops the server gracefully: waits for in-flight requests until the timeout,
+// then closes the remaining connections, so stuck provider calls don't block the shutdown
+func shutdownServer(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[WARNING] Graceful shutdown didn't complete within %s (%v), closing remaining connections\n", timeout, err)
+		if err := server.Close(); err != nil {
+			log.Printf("[ERROR] Closing the server failed: %v\n", err)
+		}
+		return
+	}
+	log.Println("Graceful shutdown completed")
+}
+
+// endregion
+
+// region Tracing
+// Tracer for /update, a no-op until setupTracing registers a tracer provider
+var tracer = otel.Tracer("github.com/0-99/dyndns-multiplexer-iid6support")
+
+// Registers an OTLP/HTTP exporter and the W3C trace context propagator.
+// The exporter is configured with the standard OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME environment variables.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "dyndns-multiplexer")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// endregion
+
+// region Metrics
+// Prometheus metrics, registered in the default registry by registerMetrics and exposed at /metrics
+var (
+	updateRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dyndns_update_requests_total",
+		Help: "Total number of accepted /update requests.",
+	})
+	providerRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyndns_provider_requests_total",
+		Help: "Total number of provider updates by provider host and matched return code.",
+	}, []string{"host", "code"})
+	providerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dyndns_provider_request_duration_seconds",
+		Help:    "Duration of the HTTP requests to the providers by provider host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+	configHealthy = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dyndns_config_healthy",
+		Help: "1 if the config was loaded successfully, 0 on a config error.",
+	}, func() float64 {
+		if currentConfigError() != nil {
+			return 0
+		}
+		return 1
+	})
+	updatesInFlightGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dyndns_update_requests_in_flight",
+		Help: "Number of /update requests that are currently handled.",
+	}, func() float64 {
+		return float64(updatesInFlight.Load())
+	})
+)
+
+// Registers the metrics once at startup
+func registerMetrics() {
+	prometheus.MustRegister(updateRequestsTotal, providerRequestsTotal, providerRequestDuration, configHealthy, updatesInFlightGauge)
+}
+
+// Counts the matched return code of a provider. The host is taken from the URI template, so no credentials are exposed.
+func recordProviderMetric(p Provider, code string) {
+	providerRequestsTotal.WithLabelValues(uriTemplateHost(p.Uri), code).Inc()
+}
+
+// Records the duration of a single HTTP request to a provider
+func observeProviderDuration(p Provider, duration time.Duration) {
+	providerRequestDuration.WithLabelValues(uriTemplateHost(p.Uri)).Observe(duration.Seconds())
+}
+
+// endregion
+
+// region Middleware
+type requestIdKey struct{}
+
+// Returns the request ID assigned by withRecover, or an empty string
+func requestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Creates a random request ID
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(clock.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Assigns a request ID and turns a panic in the handler into a 500 response with "911",
+// instead of a reset connection for the client. The panic is logged with its stack trace.
+func withRecover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestId := newRequestId()
+		w.Header().Set("X-Request-ID", requestId)
+		r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, requestId))
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				log.Printf("[PANIC] RequestID=%s Path=%s Panic=%v\n%s", requestId, r.URL.Path, rec, debug.Stack())
+				responseWithError(w, http.StatusInternalServerError, "911", "[ERROR] Internal error, RequestID="+requestId)
+			}
+		}()
+		next(w, r)
+	}
+}
+
+// Number of /update requests that are currently handled
+var updatesInFlight atomic.Int64
+
+// Semaphore for MAX_CONCURRENT_UPDATES, nil if unlimited
+var updateSlots chan struct{}
+
+// Limits the number of concurrently handled requests to MAX_CONCURRENT_UPDATES.
+// Beyond the limit, requests are rejected with 503, or queued up to CONCURRENT_UPDATES_QUEUE_TIMEOUT_MS.
+func withUpdateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		// updateSlots is created at startup, MAX_CONCURRENT_UPDATES isn't changed by a reload
+		if updateSlots != nil {
+			select {
+			case updateSlots <- struct{}{}:
+			default:
+				if config.ConcurrentUpdatesMode != "queue" {
+					rejectUpdate(w, config)
+					return
+				}
+				select {
+				case updateSlots <- struct{}{}:
+				case <-clock.After(time.Duration(config.ConcurrentUpdatesQueueMs) * time.Millisecond):
+					rejectUpdate(w, config)
+					return
+				case <-r.Context().Done():
+					return
+				}
+			}
+			defer func() { <-updateSlots }()
+		}
+		inFlight := updatesInFlight.Add(1)
+		defer updatesInFlight.Add(-1)
+		logVerbosef(config, "[REQUESTOR] In-flight /update requests: %d\n", inFlight)
+		next(w, r)
+	}
+}
+
+func rejectUpdate(w http.ResponseWriter, config *Config) {
+	respondThrottled(w, config, http.StatusServiceUnavailable, time.Second, fmt.Sprintf("[ERROR] Too many concurrent requests (in flight: %d)", updatesInFlight.Load()))
+}
+
+// Rejects /update requests of a client IP beyond RATE_LIMIT_RPS with THROTTLE_STATUS, before any provider is contacted.
+// Retry-After is the time until the next token of the client IP.
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if config != nil && config.RateLimitRps > 0 {
+			if delay, ok := rateLimiter.Allow(clientIp(r), config.RateLimitRps, config.RateLimitBurst); !ok {
+				log.Printf("[WARNING] Rate limit of %s exceeded, retry after %s\n", requestorAddr(config, r), delay)
+				respondThrottled(w, config, http.StatusTooManyRequests, delay, "[ERROR] Too many requests, RATE_LIMIT_RPS exceeded")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// Responds to a request that the server itself throttles with THROTTLE_STATUS, no provider is contacted.
+// A success status like nochg is returned with HTTP 200, so clients don't raise an alarm, any other status with failureStatus,
+// e.g. 503 or 429. Retry-After is set to retryAfter in whole seconds, at least 1.
+func respondThrottled(w http.ResponseWriter, config *Config, failureStatus int, retryAfter time.Duration, message string) {
+	status := config.ThrottleStatus
+	httpStatus := failureStatus
+	if NewStatusTracker("", "", config.SeverityMap).IsSuccess(status) {
+		httpStatus = http.StatusOK
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	responseWithError(w, httpStatus, status, message)
+}
+
+// Returns true if the request carries valid admin credentials via HTTP Basic Auth
+func isAdminRequest(config *Config, r *http.Request) bool {
+	if config == nil || config.AdminPassword == "" {
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	userValid := subtle.ConstantTimeCompare([]byte(username), []byte(config.AdminUsername)) == 1
+	passwordValid := subtle.ConstantTimeCompare([]byte(password), []byte(config.AdminPassword)) == 1
+	return ok && userValid && passwordValid
+}
+
+// Restricts the handler to HTTP Basic Auth with ADMIN_USER_NAME and ADMIN_PASSWORD.
+// Admin endpoints are disabled (404) if no ADMIN_PASSWORD is configured.
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if config == nil || config.AdminPassword == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !isAdminRequest(config, r) {
+			log.Printf("[ADMIN] Unauthorized request to %s from %s\n", r.URL.Path, requestorAddr(config, r))
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// endregion
+
+// region combineEndpoint
+// Previews the combination of an IPv6 prefix and an interface ID, e.g. /combine?prefix=2001:db8:1:2::/64&iid6=::a
+func combineEndpoint(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	network, err := parseIp6LanPrefix(q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ifaceIP, err := parseIid6(q.Get("iid6"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip6addr, err := combinePrefixAndIID6(*network, ifaceIP)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, ip6addr)
+}
+
+// endregion
+
+// region placeholdersEndpoint
+// Supported placeholder of the provider templates and where its value comes from
+type placeholderDoc struct {
+	Name        string
+	Description string
+}
+
+var placeholderDocs = []placeholderDoc{
+	{"username", "provider attribute username (masked)"},
+	{"passwd", "provider attribute passwd (masked)"},
+	{"domain", "provider attribute domain (masked according to LOG_MASK_DOMAIN)"},
+	{"ipaddr", "query param ip4lanprefix + provider attribute iid4, if the provider has iid4, otherwise query param ipaddr"},
+	{"ip6addr", "query param ip6lanprefix + provider attribute iid6, if the provider has iid6 or macs, otherwise query param ip6addr"},
+	{"ip4lanprefix", "query param ip4lanprefix"},
+	{"ip6lanprefix", "query param ip6lanprefix"},
+	{"dualstack", "query param dualstack"},
+	{"system", "query param system"},
+	{"offline", "YES if the request marks the host offline (offline=YES or ipaddr=offline), otherwise NOCHG"},
+	{"useragent", "User-Agent of the incoming request, only in user_agent and USER_AGENT"},
+	{"env:VAR", "environment variable VAR, resolved at startup (masked if the name contains e.g. key, token, secret or pass)"},
+}
+
+// Lists the supported placeholders and their values for sample query params, optionally for a provider,
+// e.g. /placeholders?provider=0&ipaddr=1.2.3.4&ip6lanprefix=2001:db8:1:2::/64
+func placeholdersEndpoint(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	q := r.URL.Query()
+	query := &QueryParams{
+		IpAddr:       q.Get("ipaddr"),
+		Ip6Addr:      q.Get("ip6addr"),
+		Ip4LanPrefix: q.Get("ip4lanprefix"),
+		Ip6LanPrefix: q.Get("ip6lanprefix"),
+		Dualstack:    q.Get("dualstack"),
+		System:       q.Get("system"),
+	}
+	if query.Ip4LanPrefix != "" {
+		network, err := parseIp4LanPrefix(query.Ip4LanPrefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Ip4LanNetwork = network
+	}
+	if query.Ip6LanPrefix != "" {
+		network, err := parseIp6LanPrefix(query.Ip6LanPrefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Ip6LanNetwork = network
+	}
+	p := Provider{}
+	index := -1
+	if providerParam := q.Get("provider"); providerParam != "" {
+		if config == nil {
+			http.Error(w, "config error, no providers available", http.StatusServiceUnavailable)
+			return
+		}
+		i, err := strconv.Atoi(providerParam)
+		if err != nil || i < 0 || i >= len(config.Providers) {
+			http.Error(w, fmt.Sprintf("invalid provider index: %s (allowed: 0 to %d)", providerParam, len(config.Providers)-1), http.StatusBadRequest)
+			return
+		}
+		p = config.Providers[i]
+		index = i
+	}
+
+	ipaddr, warning4, err := resolveIpAddr(p, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip6addr, warning, err := resolveIp6Addr(p, query, &ProviderLog{Config: config})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := placeholderValues(p, query, ipaddr, ip6addr)
+	values = append(values, placeholderValue{"useragent", sanitizeUserAgent(q.Get("useragent"))})
+	for _, doc := range placeholderDocs {
+		value := ""
+		for _, v := range values {
+			if v.Name == doc.Name && v.Value != "" {
+				value = loggingPlaceholderValue(config, v, func(s string) string { return s })
+			}
+		}
+		fmt.Fprintf(w, "<%s> = %q (%s)\n", doc.Name, value, doc.Description)
+	}
+	if index >= 0 {
+		// A copy expanded from domains or macs is shown with its index in PROVIDERS and its domain or MAC
+		label := providerIndexLabel(config, p)
+		_, loggingUri := fillUriTemplate(config, p.Uri, values)
+		fmt.Fprintf(w, "Provider[%s] uri = %s\n", label, loggingUri)
+		if p.Body != "" {
+			_, loggingBody := fillTemplate(config, p.Body, values, bodyEscaper(p.ContentType))
+			fmt.Fprintf(w, "Provider[%s] body = %s\n", label, loggingBody)
+		}
+		for _, warning := range []string{warning4, warning} {
+			if warning != "" {
+				fmt.Fprintf(w, "Provider[%s] warning = %s\n", label, warning)
+			}
+		}
+	}
+}
+
+// endregion
+
+// region inFlightEndpoint
+
+// Lists the /update requests that are currently handled, with their elapsed time and pending providers, as JSON
+func inFlightEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inFlightUpdates.Snapshot())
+}
+
+// endregion
+
+// region healthEndpoint
+
+// Liveness probe: always 200 while the process is up, also with a config error,
+// so an orchestrator doesn't restart the container in a loop. The config error is reported by /ready.
+// With "deep=1", the providers are probed instead, see deepHealthEndpoint.
+func healthEndpoint(w http.ResponseWriter, r *http.Request) {
+	if deep := r.URL.Query().Get("deep"); deep == "1" || strings.EqualFold(deep, "true") {
+		deepHealthEndpoint(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "OK")
+}
+
+// Returns the reachability of the providers as JSON: 200 if all probed providers are reachable, otherwise 503
+func deepHealthEndpoint(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	if config == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "UNHEALTHY: config error. "+cmp.Or(currentConfigError(), errors.New("no config loaded")).Error())
+		return
+	}
+	health := deepHealth.Check(config)
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// Readiness probe: 200 once a valid config is loaded, otherwise 503 with the config error
+func readyEndpoint(w http.ResponseWriter, r *http.Request) {
+	if err := currentConfigError(); err != nil || currentConfig() == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "NOT READY: config error. "+cmp.Or(err, errors.New("no config loaded")).Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "READY")
+}
+
+// endregion
+
+// region statusEndpoint
+
+// Returns the state of the last /update requests as JSON, without credentials
+func statusEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updateStatus.Snapshot())
+}
+
+// endregion
+
+// region versionEndpoint
+
+// Build metadata returned by /version
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Returns the build metadata of the running binary as JSON
+func versionEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	})
+}
+
+// endregion
+
+// region dyndnsHandler
+
+// region QueryParams
+// Pair of partially resolved URI and Provider
+type QueryParams struct {
+	Username      string     // mandatory
+	Password      string     // mandatory
+	Domain        string     // mandatory
+	IpAddr        string     // optional, one of IpAddr or Ip6Addr must be set
+	Ip6Addr       string     // optional, one of IpAddr or Ip6Addr must be set
+	Ip4LanPrefix  string     // optional
+	Ip4LanNetwork *net.IPNet // optional, derived from Ip4LanPrefix
+	Ip6LanPrefix  string     // optional
+	Ip6LanNetwork *net.IPNet // optional, derived from Ip6LanPrefix
+	Dualstack     string     // optional
+	System        string     // optional, one of allowedSystems
+	Force         bool       // optional, "force=1" bypasses the IP cache
+	Offline       bool       // optional, "offline=YES" or "ipaddr=offline" marks the host offline
+}
+
+// Update types of the DynDNS protocol, sent by clients in the query param system
+var allowedSystems = []string{"dyndns", "statdns", "custom"}
+
+// Default maximum length of a query param value, e.g. the maximum length of a domain name
+const defaultMaxParamLength = 255
+
+// Neither the username and passwd query params nor HTTP Basic Auth were sent
+var errMissingCredentials = errors.New("missing credentials: send the query params username and passwd or HTTP Basic Auth")
+
+// Parse and validate QueryParams from http.Request
+func ParseQueryParams(config *Config, r *http.Request) (*QueryParams, error) {
+	q := r.URL.Query()
+	params := &QueryParams{
+		Username:      q.Get("username"),
+		Password:      q.Get("passwd"),
+		Domain:        q.Get("domain"),
+		IpAddr:        q.Get("ipaddr"),
+		Ip6Addr:       q.Get("ip6addr"),
+		Ip4LanPrefix:  q.Get("ip4lanprefix"),
+		Ip4LanNetwork: nil, // will be set later if Ip4LanPrefix is valid
+		Ip6LanPrefix:  q.Get("ip6lanprefix"),
+		Ip6LanNetwork: nil, // will be set later if Ip6LanPrefix is valid
+		Dualstack:     q.Get("dualstack"),
+		System:        q.Get("system"),
+		Force:         q.Get("force") == "1" || strings.EqualFold(q.Get("force"), "true"),
+	}
+	// All problems are collected, so the client sees every issue at once
+	var errs []error
+	// DynDNS2 offline: "offline=YES", or "offline" instead of an address, which is not sent as an address
+	switch strings.ToLower(q.Get("offline")) {
+	case "yes", "true", "1":
+		params.Offline = true
+	case "", "no", "nochg", "false", "0":
+	default:
+		errs = append(errs, fmt.Errorf("invalid query param offline: %s (allowed: YES, NOCHG)", q.Get("offline")))
+	}
+	if strings.EqualFold(params.IpAddr, "offline") {
+		params.IpAddr, params.Offline = "", true
+	}
+	if strings.EqualFold(params.Ip6Addr, "offline") {
+		params.Ip6Addr, params.Offline = "", true
+	}
+	// Reject oversized values before they are substituted or logged
+	maxParamLength := defaultMaxParamLength
+	if config != nil {
+		maxParamLength = config.MaxParamLength
+	}
+	oversized := map[string]bool{}
+	for _, name := range []string{"username", "passwd", "domain", "ipaddr", "ip6addr", "ip4lanprefix", "ip6lanprefix", "dualstack", "system", "offline"} {
+		if len(q.Get(name)) > maxParamLength {
+			oversized[name] = true
+			errs = append(errs, fmt.Errorf("query param %s exceeds the maximum length of %d characters", name, maxParamLength))
+		}
+	}
+	// Without username and passwd query params, the credentials may be sent via HTTP Basic Auth
+	missingCredentials := false
+	if params.Username == "" && params.Password == "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			params.Username, params.Password = username, password
+		} else {
+			missingCredentials = true
+			errs = append(errs, errMissingCredentials)
+		}
+	}
+	// Validate mandatory fields
+	if params.Username == "" && !missingCredentials {
+		errs = append(errs, fmt.Errorf("missing mandatory query param: username"))
+	}
+	if params.Password == "" && !missingCredentials {
+		errs = append(errs, fmt.Errorf("missing mandatory query param: passwd"))
+	}
+	if params.Domain == "" {
+		errs = append(errs, fmt.Errorf("missing mandatory query param: domain"))
+	}
+	// At least one of IpAddr or Ip6Addr must be set, unless the host is marked offline
+	if params.IpAddr == "" && params.Ip6Addr == "" && !params.Offline {
+		errs = append(errs, fmt.Errorf("either ipaddr or ip6addr must be set"))
+	}
+	// Values are only checked if they aren't oversized, as the errors contain the value
+	if params.IpAddr != "" && !oversized["ipaddr"] && !isIPv4(params.IpAddr) {
+		errs = append(errs, fmt.Errorf("invalid query param ipaddr: %s (must be an IPv4 address)", params.IpAddr))
+	}
+	if params.Ip6Addr != "" && !oversized["ip6addr"] {
+		if !isIPv6(params.Ip6Addr) {
+			errs = append(errs, fmt.Errorf("invalid query param ip6addr: %s (must be an IPv6 address)", params.Ip6Addr))
+		} else {
+			// Canonical compressed form, e.g. "2001:0db8:0000::0001" => "2001:db8::1", like the addresses combined with iid6
+			params.Ip6Addr = net.ParseIP(params.Ip6Addr).String()
+		}
+	}
+	if params.System != "" && !oversized["system"] && !slices.Contains(allowedSystems, params.System) {
+		errs = append(errs, fmt.Errorf("invalid query param system: %s (allowed: %s)", params.System, strings.Join(allowedSystems, ", ")))
+	}
+
+	// parse ip4lanprefix if set
+	if params.Ip4LanPrefix != "" && !oversized["ip4lanprefix"] {
+		network, err := parseIp4LanPrefix(params.Ip4LanPrefix)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		params.Ip4LanNetwork = network
+	}
+
+	// parse ip6lanprefix if set
+	if params.Ip6LanPrefix != "" && !oversized["ip6lanprefix"] {
+		network, err := parseIp6LanPrefix(params.Ip6LanPrefix)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		params.Ip6LanNetwork = network
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return params, nil
+}
+
+// Returns the message of a validation error for the response. With details, all problems are joined,
+// otherwise only the first one is returned.
+func validationErrorMessage(err error, details bool) string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return err.Error()
+	}
+	errs := joined.Unwrap()
+	if !details {
+		if len(errs) > 1 {
+			return fmt.Sprintf("%v (and %d more problems)", errs[0], len(errs)-1)
+		}
+		return errs[0].Error()
+	}
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Parse and validate an IPv4 prefix in CIDR notation
+func parseIp4LanPrefix(prefix string) (*net.IPNet, error) {
+	//e.g. "192.168.24.0/24"
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR prefix: %v", err)
+	} else if _, bits := network.Mask.Size(); bits != 8*net.IPv4len {
+		// Ensure the prefix is for IPv4.
+		return nil, fmt.Errorf("the provided CIDR %s is not an IPv4 prefix", prefix)
+	}
+	return network, nil
+}
+
+// Parse and validate an IPv6 prefix in CIDR notation
+func parseIp6LanPrefix(prefix string) (*net.IPNet, error) {
+	//e.g. "cafe:babe:dead:beef::/64" or "babe:beef::/32"
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR prefix: %v", err)
+	} else if network.IP.To16() == nil {
+		// Ensure the prefix is for IPv6.
+		return nil, fmt.Errorf("the provided CIDR %s is not an IPv6 prefix", prefix)
+	}
+	return network, nil
+}
+
+// Returns true for an IPv4 address in dotted notation, e.g. "1.2.3.4" (IPv4-mapped IPv6 addresses are not accepted)
+func isIPv4(value string) bool {
+	ip := net.ParseIP(value)
+	return ip != nil && ip.To4() != nil && !strings.Contains(value, ":")
+}
+
+// Returns true for an IPv6 address, e.g. "2001:db8::1" (IPv4 and IPv4-mapped IPv6 addresses are not accepted)
+func isIPv6(value string) bool {
+	ip := net.ParseIP(value)
+	return ip != nil && ip.To4() == nil
+}
+
+// Returns the raw value of a query param by its name
+func (q *QueryParams) Get(name string) string {
+	switch name {
+	case "domain":
+		return q.Domain
+	case "ipaddr":
+		return q.IpAddr
+	case "ip6addr":
+		return q.Ip6Addr
+	case "ip4lanprefix":
+		return q.Ip4LanPrefix
+	case "ip6lanprefix":
+		return q.Ip6LanPrefix
+	case "dualstack":
+		return q.Dualstack
+	case "system":
+		return q.System
+	case "offline":
+		return q.OfflineValue()
+	}
+	return ""
+}
+
+// Returns the value of <offline> like in the DynDNS2 protocol: "YES" if the host is marked offline, otherwise "NOCHG"
+func (q *QueryParams) OfflineValue() string {
+	if q.Offline {
+		return "YES"
+	}
+	return "NOCHG"
+}
+
+// endregion
+
+// region StatusTracker
+// Tracks status and severity for DynDNS responses
+type StatusTracker struct {
+	SeverityMap  map[string]int
+	Highest      int
+	FinalStatus  string
+	HeaderStatus string
+	ResponseIp   string
+	Total        int            // number of checked provider results
+	Succeeded    int            // number of provider results with good, ok or nochg
+	Failed       int            // number of provider results with any other return code
+	Counts       map[string]int // number of provider results per return code
+}
+
+// Severity values according to DynDNS v2 protocol (https://help.dyn.com/remote-access-api/return-codes/).
+// A higher severity wins in the aggregated status, return codes up to the severity of "good" are successes.
+func defaultSeverityMap() map[string]int {
+	return map[string]int{
+		"badauth":  12,
+		"notfqdn":  11,
+		"nohost":   10,
+		"numhost":  9,
+		"abuse":    8,
+		"badagent": 7,
+		"!yours":   6,
+		"!donator": 5,
+		"911":      4,
+		"dnserr":   3,
+		"unknown":  2,
+		"good":     1,
+		"ok":       0,
+		"nochg":    -1,
+	}
+}
+
+// Names that can't be return codes in SEVERITY_MAP, as they are counts of the success condition or pseudo return codes
+var reservedReturnCodes = []string{"total", "succeeded", "failed", "timeout", "cancelled"}
+
+// Parses SEVERITY_MAP, a JSON object of return code -> integer severity, and merges it over the default severities
+func parseSeverityMap(value string) (map[string]int, error) {
+	severityMap := defaultSeverityMap()
+	if strings.TrimSpace(value) == "" {
+		return severityMap, nil
+	}
+	var overrides map[string]json.Number
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("SEVERITY_MAP must be a JSON object of return code -> severity, e.g. {\"grace\": 1}: %v", err)
+	}
+	for code, severity := range overrides {
+		if code == "" || strings.ContainsFunc(code, unicode.IsSpace) {
+			return nil, fmt.Errorf("SEVERITY_MAP has an invalid return code %q (must not be empty or contain whitespace)", code)
+		}
+		if slices.Contains(reservedReturnCodes, code) {
+			return nil, fmt.Errorf("SEVERITY_MAP must not contain the reserved name %s", code)
+		}
+		value, err := strconv.Atoi(severity.String())
+		if err != nil {
+			return nil, fmt.Errorf("SEVERITY_MAP has a non-integer severity for %s: %s", code, severity)
+		}
+		severityMap[code] = value
+	}
+	return severityMap, nil
+}
+
+// Creates a tracker with the severities of severityMap, e.g. Config.SeverityMap. The map is not modified.
+func NewStatusTracker(ipv4, ipv6 string, severityMap map[string]int) *StatusTracker {
+	var responseIp string
+	if ipv4 == "" {
+		responseIp = ipv6
+	} else {
+		responseIp = ipv4
+		if ipv6 != "" {
+			responseIp = ipv4 + " " + ipv6
+		}
+	}
+
+	return &StatusTracker{
+		SeverityMap:  severityMap,
+		Highest:      -1,
+		FinalStatus:  strings.TrimSpace("nochg " + responseIp),
+		HeaderStatus: "nochg",
+		ResponseIp:   responseIp,
+		Counts:       map[string]int{},
+	}
+}
+
+// Checks and updates severity and finalStatus, returns the matched return code
+func (s *StatusTracker) CheckStatus(result string, exactReturnCodeMatch bool) string {
+	return s.CheckStatusWithDefault(result, exactReturnCodeMatch, "unknown")
+}
+
+// Same as CheckStatus, but uses defaultCode instead of "unknown" if no return code matches
+func (s *StatusTracker) CheckStatusWithDefault(result string, exactReturnCodeMatch bool, defaultCode string) string {
+	status := s.MatchStatus(result, exactReturnCodeMatch, defaultCode)
+	log.Println("Matched return code: " + status)
+	s.record(status, status)
+	return status
+}
+
+// Returns the return code matching the result, or defaultCode if no return code matches.
+// Return codes are tried in a fixed order (descending severity), and a return code at the start of the result
+// is preferred over one that is only contained in it, so the match is reproducible for ambiguous results.
+// It doesn't modify the tracker and can be called concurrently.
+func (s *StatusTracker) MatchStatus(result string, exactReturnCodeMatch bool, defaultCode string) string {
+	codes := s.ReturnCodes()
+	if exactReturnCodeMatch {
+		if _, ok := s.SeverityMap[result]; ok {
+			return result
+		}
+		return defaultCode
+	}
+	for _, code := range codes {
+		if strings.HasPrefix(result, code) {
+			return code
+		}
+	}
+	for _, code := range codes {
+		if strings.Contains(result, code) {
+			return code
+		}
+	}
+	return defaultCode
+}
+
+// Returns the return codes ordered by descending severity, return codes with the same severity by name
+func (s *StatusTracker) ReturnCodes() []string {
+	codes := make([]string, 0, len(s.SeverityMap))
+	for code := range s.SeverityMap {
+		codes = append(codes, code)
+	}
+	slices.SortFunc(codes, func(a, b string) int {
+		if c := cmp.Compare(s.SeverityMap[b], s.SeverityMap[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return codes
+}
+
+// Records a provider that didn't respond in time. The result is counted as "timeout",
+// but aggregated as "911", so the final status doesn't depend on which provider timed out.
+func (s *StatusTracker) CheckTimeout() string {
+	log.Println("Matched return code: timeout")
+	s.record("timeout", "911")
+	return "timeout"
+}
+
+// Records a provider request that was cancelled because the client disconnected.
+// Like a timeout, it is counted as "cancelled", but aggregated as "911".
+func (s *StatusTracker) CheckCancelled() string {
+	log.Println("Matched return code: cancelled")
+	s.record("cancelled", "911")
+	return "cancelled"
+}
+
+// Counts the result and updates the final status if the return code has a higher severity
+func (s *StatusTracker) record(result string, code string) {
+	s.Total++
+	if s.IsSuccess(code) {
+		s.Succeeded++
+	} else {
+		s.Failed++
+	}
+	s.Counts[result]++
+	if sev := s.SeverityMap[code]; sev > s.Highest {
+		s.Highest = sev
+		s.setFinalStatus(code)
+	}
+}
+
+// Returns true for return codes that mean success (good, ok, nochg), false for all others, e.g. "timeout"
+func (s *StatusTracker) IsSuccess(status string) bool {
+	severity, ok := s.SeverityMap[status]
+	return ok && severity <= s.SeverityMap["good"]
+}
+
+// Overrides the aggregated status with the return code of a single provider, e.g. the one that succeeded with failover
+func (s *StatusTracker) UseStatus(code string) {
+	s.Highest = s.SeverityMap[code]
+	s.setFinalStatus(code)
+}
+
+// Replaces the IP echoed in good and nochg responses, e.g. with the IP reported by a provider
+func (s *StatusTracker) SetResponseIp(ip string) {
+	s.ResponseIp = ip
+	s.setFinalStatus(s.HeaderStatus)
+}
+
+// Sets HeaderStatus and FinalStatus for the given return code
+func (s *StatusTracker) setFinalStatus(status string) {
+	s.HeaderStatus = status
+	// Set finalStatus according to DynDNS v2 protocol
+	// https://help.dyn.com/remote-access-api/return-codes/
+	// Note: For confirmation purposes, good and nochg messages will be followed by the IP address that the hostname was updated to.
+	// This value will be separated from the return code by a space.
+	switch {
+	case (status == "good" || status == "nochg") && s.ResponseIp != "":
+		s.FinalStatus = status + " " + s.ResponseIp
+	default:
+		s.FinalStatus = status
+	}
+}
+
+// Overrides the aggregated status with the result of the success condition.
+// If the condition is met, the result is "good" (at least one provider returned good) or "nochg".
+// If the condition is not met, a failure status is kept, a success status is replaced by "911".
+func (s *StatusTracker) ApplySuccessCondition(condition *SuccessCondition) {
+	if condition.Eval(s.ConditionValues()) {
+		if s.Counts["good"] > 0 {
+			s.setFinalStatus("good")
+		} else {
+			s.setFinalStatus("nochg")
+		}
+	} else if s.Highest <= s.SeverityMap["good"] {
+		s.setFinalStatus("911")
+	}
+	log.Printf("Success condition %q evaluated, final status: %s\n", condition.Expression, s.HeaderStatus)
+}
+
+// Returns the values that can be referenced in a success condition
+func (s *StatusTracker) ConditionValues() map[string]int {
+	values := map[string]int{
+		"total":     s.Total,
+		"succeeded": s.Succeeded,
+		"failed":    s.Failed,
+		"timeout":   s.Counts["timeout"],
+	}
+	for code := range s.SeverityMap {
+		values[code] = s.Counts[code]
+	}
+	return values
+}
+
+// endregion
+
+// region SuccessCondition
+// A comparison of a result count with another count or a number, e.g. "failed == 0"
+type conditionComparison struct {
+	Left     string
+	Operator string
+	Right    string
+}
+
+// Condition over the provider results that defines the overall success, e.g. "good >= 1 && failed == 0".
+// Comparisons can be combined with "&&" and "||", where "&&" binds stronger than "||".
+type SuccessCondition struct {
+	Expression string
+	anyOf      [][]conditionComparison // disjunction of conjunctions
+}
+
+var conditionOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// Parses and validates the expression, names are checked against the allowed names
+func ParseSuccessCondition(expression string, names []string) (*SuccessCondition, error) {
+	condition := &SuccessCondition{Expression: expression}
+	for _, orPart := range strings.Split(expression, "||") {
+		var allOf []conditionComparison
+		for _, andPart := range strings.Split(orPart, "&&") {
+			andPart = strings.TrimSpace(andPart)
+			comparison := conditionComparison{}
+			for _, op := range conditionOperators {
+				if left, right, found := strings.Cut(andPart, op); found {
+					comparison = conditionComparison{Left: strings.TrimSpace(left), Operator: op, Right: strings.TrimSpace(right)}
+					break
+				}
+			}
+			if comparison.Operator == "" {
+				return nil, fmt.Errorf("missing comparison operator in %q (allowed: %s)", andPart, strings.Join(conditionOperators, " "))
+			}
+			for _, operand := range []string{comparison.Left, comparison.Right} {
+				if !isConditionOperand(operand, names) {
+					return nil, fmt.Errorf("invalid operand %q in %q (allowed: a number or one of %s)", operand, andPart, strings.Join(names, ", "))
+				}
+			}
+			allOf = append(allOf, comparison)
+		}
+		condition.anyOf = append(condition.anyOf, allOf)
+	}
+	return condition, nil
+}
+
+func isConditionOperand(operand string, names []string) bool {
+	if _, err := strconv.Atoi(operand); err == nil {
+		return true
+	}
+	for _, name := range names {
+		if operand == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates the condition with the given values
+func (c *SuccessCondition) Eval(values map[string]int) bool {
+	for _, allOf := range c.anyOf {
+		matched := true
+		for _, comparison := range allOf {
+			if !comparison.eval(values) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c conditionComparison) eval(values map[string]int) bool {
+	left, right := conditionOperandValue(c.Left, values), conditionOperandValue(c.Right, values)
+	switch c.Operator {
+	case ">=":
+		return left >= right
+	case "<=":
+		return left <= right
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case ">":
+		return left > right
+	case "<":
+		return left < right
+	}
+	return false
+}
+
+func conditionOperandValue(operand string, values map[string]int) int {
+	if n, err := strconv.Atoi(operand); err == nil {
+		return n
+	}
+	return values[operand]
+}
+
+// endregion
+
+// region IPv6 Helper
+// Parse and validate an IPv6 interface ID, e.g. "::a" or "::cafe:babe:dead:beef"
+func parseIid6(iid6 string) (net.IP, error) {
+	ifaceIP := net.ParseIP(iid6)
+	if ifaceIP == nil || ifaceIP.To16() == nil {
+		return nil, fmt.Errorf("invalid interface ID: %s", iid6)
+	}
+	return ifaceIP, nil
+}
+
+// Parse and validate an IPv4 host part, e.g. "0.0.0.11"
+func parseIid4(iid4 string) (net.IP, error) {
+	if !isIPv4(iid4) {
+		return nil, fmt.Errorf("invalid IPv4 host part: %s", iid4)
+	}
+	return net.ParseIP(iid4).To4(), nil
+}
+
+// Combines an IPv4 CIDR prefix with a host part, e.g. "192.168.24.0/24" and "0.0.0.11" => "192.168.24.11"
+func combinePrefixAndIID4(network net.IPNet, ifaceIP net.IP) (string, error) {
+	if _, bits := network.Mask.Size(); bits != 8*net.IPv4len {
+		return "", fmt.Errorf("prefix %s is not an IPv4 prefix", network.String())
+	}
+	prefixIP4 := network.IP.To4()
+	ifaceIP4 := ifaceIP.To4()
+	if prefixIP4 == nil || ifaceIP4 == nil {
+		return "", fmt.Errorf("invalid prefix or host part")
+	}
+	// Like for IPv6, the host part must not have bits set in the prefix part
+	finalIP := make(net.IP, net.IPv4len)
+	for i := 0; i < net.IPv4len; i++ {
+		if ifaceIP4[i]&network.Mask[i] != 0 {
+			return "", fmt.Errorf("host part contains bits that overlap with the prefix")
+		}
+		finalIP[i] = prefixIP4[i]&network.Mask[i] | ifaceIP4[i]
+	}
+	return finalIP.String(), nil
+}
+
+// Derive the modified EUI-64 interface ID from a MAC address (RFC 4291, Appendix A), e.g. "00:11:22:33:44:55" => "::211:22ff:fe33:4455"
+func eui64FromMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid MAC address: %s", mac)
+	}
+	iid := make(net.IP, net.IPv6len)
+	iid[8] = hw[0] ^ 0x02 // flip the universal/local bit
+	iid[9] = hw[1]
+	iid[10] = hw[2]
+	iid[11] = 0xff
+	iid[12] = 0xfe
+	iid[13] = hw[3]
+	iid[14] = hw[4]
+	iid[15] = hw[5]
+	return iid.String(), nil
+}
+
+// Replace every provider with domains or macs by one copy per domain and MAC, so each domain and address is updated and tracked separately.
+// Both lists are expanded in one pass over PROVIDERS, every copy keeps the index in PROVIDERS for config errors and logs.
+func expandProviders(providers []Provider) ([]Provider, error) {
+	expanded := make([]Provider, 0, len(providers))
+	for i, p := range providers {
+		if len(p.Domains) > 0 && p.Domain != "" {
+			return nil, fmt.Errorf("provider at index %d must not define domain together with domains", i)
+		}
+		if len(p.Macs) > 0 && p.Iid6 != "" {
+			return nil, fmt.Errorf("provider at index %d must not define iid6 together with macs", i)
+		}
+		p.OriginalIndex = i
+		copies := []Provider{p}
+		if len(p.Domains) > 0 {
+			copies = copies[:0]
+			for _, domain := range p.Domains {
+				if strings.TrimSpace(domain) == "" {
+					return nil, fmt.Errorf("provider at index %d has an empty entry in domains", i)
+				}
+				copied := p
+				copied.Domains = nil
+				copied.Domain = domain
+				copied.ExpandedDomain = true
+				copies = append(copies, copied)
+			}
+		}
+		if len(p.Macs) > 0 {
+			iid6s := make([]net.IP, 0, len(p.Macs))
+			for _, mac := range p.Macs {
+				iid6, err := eui64FromMac(mac)
+				if err != nil {
+					return nil, fmt.Errorf("provider at index %d has an invalid entry in macs: %v", i, err)
+				}
+				iid6s = append(iid6s, net.ParseIP(iid6))
+			}
+			// One copy per domain and MAC
+			withMacs := make([]Provider, 0, len(copies)*len(iid6s))
+			for _, c := range copies {
+				for j, iid6 := range iid6s {
+					copied := c
+					copied.Macs = nil
+					copied.Iid6 = iid6.String()
+					copied.Iid6Masked = iid6
+					copied.ExpandedMac = p.Macs[j]
+					withMacs = append(withMacs, copied)
+				}
+			}
+			copies = withMacs
+		}
+		expanded = append(expanded, copies...)
+	}
+	return expanded, nil
+}
+
+// Returns the number of providers a provider is expanded into by its domains and macs
+func expandedCount(p Provider) int {
+	return max(1, len(p.Domains)) * max(1, len(p.Macs))
+}
+
+// Returns the index of a provider in PROVIDERS for config errors and logs, for a copy expanded from domains or macs
+// together with its domain and MAC, e.g. "1 (domain b.example.com)"
+func providerIndexLabel(config *Config, p Provider) string {
+	var expandedFrom []string
+	if p.ExpandedDomain {
+		expandedFrom = append(expandedFrom, "domain "+logDomain(config, p.Domain))
+	}
+	if p.ExpandedMac != "" {
+		expandedFrom = append(expandedFrom, "mac "+p.ExpandedMac)
+	}
+	if len(expandedFrom) == 0 {
+		return strconv.Itoa(p.OriginalIndex)
+	}
+	return fmt.Sprintf("%d (%s)", p.OriginalIndex, strings.Join(expandedFrom, ", "))
+}
+
+// Returns the longest prefix length that an interface ID fits, i.e. the number of leading zero bits, e.g. 64 for "::1:2:3:4"
+func maxPrefixLength(ifaceIP net.IP) int {
+	length := 0
+	for _, b := range ifaceIP.To16() {
+		if b != 0 {
+			return length + bits.LeadingZeros8(b)
+		}
+		length += 8
+	}
+	return length
+}
+
+// combineIPv6 combines an IPv6 CIDR prefix with an interface ID.
+func combinePrefixAndIID6(network net.IPNet, ifaceIP net.IP) (string, error) {
+	//  Validate that the interface ID doesn't overlap with the prefix.
+	// We do this by masking the interface IP with the network mask.
+	// If the result is not '::', it means the interface ID has bits
+	// set in the prefix part, which is an invalid input.
+	// The check is done bitwise, so prefixes that are not a multiple of 8 (e.g. /56 or /60) are handled correctly.
+	if _, bits := network.Mask.Size(); bits != 8*net.IPv6len {
+		return "", fmt.Errorf("prefix %s is not an IPv6 prefix", network.String())
+	}
+	prefixIP16 := network.IP.To16()
+	ifaceIP16 := ifaceIP.To16()
+	if prefixIP16 == nil || ifaceIP16 == nil {
+		return "", fmt.Errorf("invalid prefix or interface ID")
+	}
+	overlap := make(net.IP, net.IPv6len)
+	overlaps := false
+	for i := 0; i < net.IPv6len; i++ {
+		overlap[i] = ifaceIP16[i] & network.Mask[i]
+		overlaps = overlaps || overlap[i] != 0
+	}
+	if overlaps {
+		// E.g. a 64-bit interface ID is valid with a /64 prefix, but its upper bits collide with a /56 prefix
+		ones, _ := network.Mask.Size()
+		return "", fmt.Errorf("interface ID %s has bits in the /%d prefix %s (overlapping bits: %s), it fits a prefix of at most /%d",
+			ifaceIP16.String(), ones, network.String(), overlap.String(), maxPrefixLength(ifaceIP16))
+	}
+
+	// Combine the two parts at the binary level: the prefix bits from the network,
+	// the remaining bits from the interface ID. The byte at the boundary of a prefix
+	// that is not a multiple of 8 contains bits of both parts.
+	finalIP := make(net.IP, net.IPv6len)
+	for i := 0; i < net.IPv6len; i++ {
+		finalIP[i] = prefixIP16[i]&network.Mask[i] | ifaceIP16[i]&^network.Mask[i]
+	}
+
+	return finalIP.String(), nil
+}
+
+// endregion
+
+// region Clock
+// Source of time for all time-dependent behavior, can be replaced to control time deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker of a Clock, delivers the ticks on C until it is stopped
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clock based on the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+// Ticker based on time.Ticker
+type realTicker struct{ ticker *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+var clock Clock = realClock{}
+
+// endregion
+
+// region Counters
+// Counters of the /update requests and the provider results
+type Counters struct {
+	mu           sync.Mutex
+	TotalUpdates int64                        `json:"total_updates"`
+	Providers    map[string]*ProviderCounters `json:"providers"` // key is the provider index
+}
+
+type ProviderCounters struct {
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+var counters = &Counters{Providers: map[string]*ProviderCounters{}}
+
+func (c *Counters) RecordUpdate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TotalUpdates++
+}
+
+func (c *Counters) RecordProvider(index int, success bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strconv.Itoa(index)
+	pc, ok := c.Providers[key]
+	if !ok {
+		pc = &ProviderCounters{}
+		c.Providers[key] = pc
+	}
+	if success {
+		pc.Succeeded++
+	} else {
+		pc.Failed++
+	}
+}
+
+// Loads the counters from the file. A missing or corrupt file is logged and the counters start at zero.
+func (c *Counters) Load(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[COUNTERS] File %s does not exist yet, starting with empty counters\n", path)
+		return
+	} else if err != nil {
+		log.Printf("[WARNING] Failed to read counters file %s, starting with empty counters: %v\n", path, err)
+		return
+	}
+	loaded := &Counters{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		log.Printf("[WARNING] Corrupt counters file %s, starting with empty counters: %v\n", path, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TotalUpdates = loaded.TotalUpdates
+	if loaded.Providers != nil {
+		c.Providers = loaded.Providers
+	}
+	log.Printf("[COUNTERS] Loaded from %s: total_updates=%d\n", path, c.TotalUpdates)
+}
+
+// Writes the counters to the file. The file is replaced atomically, so a crash never leaves a partial file.
+func (c *Counters) Save(path string) {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		log.Printf("[WARNING] Failed to persist counters to %s: %v\n", path, err)
+	}
+}
+
+func (c *Counters) PersistPeriodically(path string, interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		c.Save(path)
+	}
+}
+
+// Writes the data to a temporary file in the same directory and renames it to path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// endregion
+
+// region Last Result
+// Result of the last /update request, written to LAST_RESULT_FILE for external tooling
+type LastResult struct {
+	Time       time.Time            `json:"time"`
+	RequestId  string               `json:"request_id"`
+	Status     string               `json:"status"`      // final status as returned to the client, e.g. "good 1.2.3.4"
+	ReturnCode string               `json:"return_code"` // return code of the final status, e.g. "good"
+	Total      int                  `json:"total"`
+	Succeeded  int                  `json:"succeeded"`
+	Failed     int                  `json:"failed"`
+	Providers  []LastProviderResult `json:"providers"`
+}
+
+// Result of a single provider in LAST_RESULT_FILE, without URL and credentials
+type LastProviderResult struct {
+	Index        int    `json:"index"`
+	Skipped      bool   `json:"skipped,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Verification string `json:"verification,omitempty"`
+}
+
+// Collects the last result from the tracker and the provider results
+func newLastResult(requestId string, tracker *StatusTracker, results []ProviderResult) LastResult {
+	last := LastResult{
+		Time:       clock.Now().UTC(),
+		RequestId:  requestId,
+		Status:     tracker.FinalStatus,
+		ReturnCode: tracker.HeaderStatus,
+		Total:      tracker.Total,
+		Succeeded:  tracker.Succeeded,
+		Failed:     tracker.Failed,
+		Providers:  make([]LastProviderResult, 0, len(results)),
+	}
+	for _, result := range results {
+		last.Providers = append(last.Providers, LastProviderResult{
+			Index:        result.Index,
+			Skipped:      result.Skipped,
+			Code:         result.Code,
+			Verification: result.Verification,
+		})
+	}
+	return last
+}
+
+// Serializes the writes of concurrent /update requests, so the file always contains the result that finished last
+type LastResultWriter struct {
+	mu sync.Mutex
+}
+
+var lastResult = &LastResultWriter{}
+
+// Writes the result to the file. The file is replaced atomically, so readers never see a partial file.
+func (l *LastResultWriter) Save(path string, result LastResult) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		l.mu.Lock()
+		err = writeFileAtomic(path, data)
+		l.mu.Unlock()
+	}
+	if err != nil {
+		log.Printf("[WARNING] Failed to write the last result to %s: %v\n", path, err)
+	}
+}
+
+// endregion
+
+// region Update Status
+// State of the last /update requests, returned by /status
+type UpdateStatus struct {
+	LastUpdate *time.Time       `json:"last_update"`           // time of the last /update that reached the providers, null before the first one
+	ReturnCode string           `json:"return_code,omitempty"` // aggregate return code of the last update
+	ResponseIp string           `json:"response_ip,omitempty"` // IP addresses returned to the client by the last update
+	Providers  []ProviderStatus `json:"providers"`
+}
+
+// Last seen return code of a provider. Only the host is exposed, never the URL or credentials.
+type ProviderStatus struct {
+	Index    int       `json:"index"`
+	Host     string    `json:"host"`
+	Code     string    `json:"code"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Thread-safe store of the update status, updated at the end of every /update
+type UpdateStatusStore struct {
+	mu        sync.Mutex
+	status    UpdateStatus
+	providers map[int]ProviderStatus // provider index -> last seen return code, skipped providers keep their last one
+}
+
+var updateStatus = &UpdateStatusStore{providers: map[int]ProviderStatus{}}
+
+// Records the aggregate status and the return codes of the contacted providers
+func (s *UpdateStatusStore) Record(tracker *StatusTracker, results []ProviderResult) {
+	now := clock.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastUpdate = &now
+	s.status.ReturnCode = tracker.HeaderStatus
+	s.status.ResponseIp = tracker.ResponseIp
+	for _, result := range results {
+		if result.Skipped {
+			continue
+		}
+		s.providers[result.Index] = ProviderStatus{Index: result.Index, Host: result.Host, Code: result.Code, LastSeen: now}
+	}
+}
+
+// Returns a copy of the status with the providers ordered by index
+func (s *UpdateStatusStore) Snapshot() UpdateStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Providers = make([]ProviderStatus, 0, len(s.providers))
+	for _, provider := range s.providers {
+		status.Providers = append(status.Providers, provider)
+	}
+	slices.SortFunc(status.Providers, func(a, b ProviderStatus) int { return cmp.Compare(a.Index, b.Index) })
+	return status
+}
+
+// Forgets the provider status, e.g. after a config reload, when the indexes may belong to other providers
+func (s *UpdateStatusStore) ResetProviders() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers = map[int]ProviderStatus{}
+}
+
+// endregion
+
+// region In-Flight Registry
+// /update request that is currently handled, returned by /inflight
+type InFlightUpdate struct {
+	RequestId        string            `json:"request_id"`
+	Started          time.Time         `json:"started"`
+	ElapsedMs        int64             `json:"elapsed_ms"`
+	PendingProviders []PendingProvider `json:"pending_providers"`
+}
+
+// Provider whose update is not finished yet, identified by index and host only
+type PendingProvider struct {
+	Index int    `json:"index"`
+	Host  string `json:"host"`
+}
+
+type inFlightEntry struct {
+	requestId string
+	started   time.Time
+	pending   map[int]string // provider index -> host of the providers that are not done yet
+}
+
+// Thread-safe registry of the /update requests that are currently handled, to diagnose stuck requests
+type InFlightRegistry struct {
+	mu      sync.Mutex
+	nextId  uint64
+	entries map[uint64]*inFlightEntry // request IDs may be sent by the client and are not unique
+}
+
+var inFlightUpdates = &InFlightRegistry{entries: map[uint64]*inFlightEntry{}}
+
+// Registers a request with all providers pending, returns the key for ProviderDone and Finish
+func (reg *InFlightRegistry) Start(requestId string, providers []Provider) uint64 {
+	entry := &inFlightEntry{requestId: requestId, started: clock.Now().UTC(), pending: map[int]string{}}
+	for i, p := range providers {
+		entry.pending[i] = uriTemplateHost(p.Uri)
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.nextId++
+	reg.entries[reg.nextId] = entry
+	return reg.nextId
+}
+
+// Marks the provider of the request as done
+func (reg *InFlightRegistry) ProviderDone(key uint64, index int) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if entry, ok := reg.entries[key]; ok {
+		delete(entry.pending, index)
+	}
+}
+
+// Removes the request from the registry
+func (reg *InFlightRegistry) Finish(key uint64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.entries, key)
+}
+
+// Returns the requests ordered by start time, the pending providers ordered by index
+func (reg *InFlightRegistry) Snapshot() []InFlightUpdate {
+	now := clock.Now()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	updates := make([]InFlightUpdate, 0, len(reg.entries))
+	for _, entry := range reg.entries {
+		update := InFlightUpdate{
+			RequestId:        entry.requestId,
+			Started:          entry.started,
+			ElapsedMs:        now.Sub(entry.started).Milliseconds(),
+			PendingProviders: make([]PendingProvider, 0, len(entry.pending)),
+		}
+		for index, host := range entry.pending {
+			update.PendingProviders = append(update.PendingProviders, PendingProvider{Index: index, Host: host})
+		}
+		slices.SortFunc(update.PendingProviders, func(a, b PendingProvider) int { return cmp.Compare(a.Index, b.Index) })
+		updates = append(updates, update)
+	}
+	slices.SortFunc(updates, func(a, b InFlightUpdate) int { return a.Started.Compare(b.Started) })
+	return updates
+}
+
+// endregion
+
+// region IP Cache
+// Addresses that were last sent successfully to a provider
+type ipCacheEntry struct {
+	IpAddr  string    `json:"ipaddr,omitempty"`
+	Ip6Addr string    `json:"ip6addr,omitempty"`
+	Time    time.Time `json:"time"` // time of the last request, cached results don't refresh it
+}
+
+// Last successfully sent addresses per provider, so unchanged addresses are not sent again until the TTL expires
+type IpCache struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex              // serializes the writes of STATE_FILE, so the file always contains the latest entries
+	entries map[string]ipCacheEntry // ipCacheKey -> last sent addresses
+}
+
+var ipCache = &IpCache{entries: map[string]ipCacheEntry{}}
+
+// Returns the cache key of a provider, the domain is part of it, so a changed provider at the same index is updated
+func ipCacheKey(index int, domain string) string {
+	return strconv.Itoa(index) + "|" + domain
+}
+
+// Returns the time of the last request and true if the addresses were sent successfully within the TTL
+func (c *IpCache) Unchanged(key string, ipaddr string, ip6addr string, ttl time.Duration) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || entry.IpAddr != ipaddr || entry.Ip6Addr != ip6addr {
+		return time.Time{}, false
+	}
+	return entry.Time, clock.Now().Sub(entry.Time) < ttl
+}
+
+// Stores the addresses that were sent successfully
+func (c *IpCache) Store(key string, ipaddr string, ip6addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = ipCacheEntry{IpAddr: ipaddr, Ip6Addr: ip6addr, Time: clock.Now().UTC()}
+}
+
+// Removes the entry of a key, e.g. after the host was marked offline
+func (c *IpCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// Reads the entries from STATE_FILE. A missing or corrupt file is logged and the cache starts empty,
+// so all providers are updated once.
+func (c *IpCache) Load(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[STATE] File %s does not exist yet, starting with an empty IP cache\n", path)
+		return
+	} else if err != nil {
+		log.Printf("[WARNING] Failed to read state file %s, starting with an empty IP cache: %v\n", path, err)
+		return
+	}
+	var loaded map[string]ipCacheEntry
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("[WARNING] Corrupt state file %s, starting with an empty IP cache: %v\n", path, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if loaded != nil {
+		c.entries = loaded
+	}
+	log.Printf("[STATE] Loaded from %s: %d cached providers\n", path, len(c.entries))
+}
+
+// Writes the entries to STATE_FILE. The file is replaced atomically, so a crash never leaves a partial file.
+func (c *IpCache) Save(path string) {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		log.Printf("[WARNING] Failed to write state file %s: %v\n", path, err)
+	}
+}
+
+// Forgets all addresses, e.g. after a config reload, when the indexes may belong to other providers
+func (c *IpCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]ipCacheEntry{}
+}
+
+// endregion
+
+// region Update Pacing
+// Tracks per provider when the next update is allowed, based on the TTL hint of the provider or min_update_interval_s
+type UpdatePacing struct {
+	mu   sync.Mutex
+	next map[int]time.Time // provider index -> next allowed update
+}
+
+var updatePacing = &UpdatePacing{next: map[int]time.Time{}}
+
+// Returns the time of the next allowed update and true if the provider must not be updated yet
+func (u *UpdatePacing) NextUpdate(index int) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	next, ok := u.next[index]
+	return next, ok && clock.Now().Before(next)
+}
+
+// Sets the next allowed update from the TTL hint header, falls back to min_update_interval_s
+func (u *UpdatePacing) Apply(index int, p Provider, header http.Header, plog *ProviderLog) {
+	interval := time.Duration(p.MinUpdateIntervalS) * time.Second
+	if p.TtlHeader != "" {
+		if value := strings.TrimSpace(header.Get(p.TtlHeader)); value != "" {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				interval = time.Duration(seconds) * time.Second
+			} else {
+				plog.Printf("[WARNING] Index=%d Invalid TTL hint in header %s: %s\n", index, p.TtlHeader, value)
+			}
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.next[index] = clock.Now().Add(interval)
+	plog.Verbosef("[PACING] Index=%d Next update allowed in %s\n", index, interval)
+}
+
+// Forgets all pacing, e.g. after a config reload, when the indexes may belong to other providers
+func (u *UpdatePacing) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.next = map[int]time.Time{}
+}
+
+// endregion
+
+// region Rate Limiter
+// Interval of the removal of idle limiters
+const rateLimiterCleanupInterval = time.Minute
+
+// Token buckets of RATE_LIMIT_RPS per client IP
+type RateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter // client IP -> token bucket
+}
+
+var rateLimiter = &RateLimiter{limiters: map[string]*rate.Limiter{}}
+
+// Takes a token of the client IP. If none is left, returns false and the time until the next token.
+func (l *RateLimiter) Allow(ip string, rps float64, burst int) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[ip]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(rps), burst)
+		l.limiters[ip] = limiter
+	}
+	now := clock.Now()
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// The token isn't taken, a rejected request doesn't extend the wait
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// Removes the limiters with a full bucket, they behave like new ones
+func (l *RateLimiter) Cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := clock.Now()
+	for ip, limiter := range l.limiters {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// Removes idle limiters every interval, so the map doesn't grow with every client IP
+func (l *RateLimiter) CleanupPeriodically(interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		l.Cleanup()
+	}
+}
+
+// Forgets all limiters, e.g. after a config reload with another RATE_LIMIT_RPS
+func (l *RateLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limiters = map[string]*rate.Limiter{}
+}
+
+// Returns the IP of the TCP peer of a request, the key of the rate limit.
+// Proxy headers are not used, as clients could send a new value with every request.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// endregion
+
+// region Request Diff
+// Request to a provider with masked credentials, as it is logged
+type maskedRequest struct {
+	Method string
+	Url    string
+	Body   string
+}
+
+// Last masked request per provider index, to log what changed between two updates of a provider
+type lastRequestStore struct {
+	mu       sync.Mutex
+	requests map[int]maskedRequest
+}
+
+var lastRequests = &lastRequestStore{requests: map[int]maskedRequest{}}
+
+// Returns the differences between req and the last request of the provider, nil for the first request.
+// If store is true, req becomes the last request.
+func (s *lastRequestStore) Diff(index int, req maskedRequest, store bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.requests[index]
+	if store {
+		s.requests[index] = req
+	}
+	if !ok {
+		return nil
+	}
+	return diffRequests(last, req)
+}
+
+// Forgets all last requests, e.g. after a config reload, when the indexes may belong to other providers
+func (s *lastRequestStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = map[int]maskedRequest{}
+}
+
+// Returns the differences between two requests, e.g. "ipaddr: 1.2.3.4 -> 5.6.7.8".
+// Query params are compared one by one, the rest of the URL and the body as a whole.
+func diffRequests(last maskedRequest, current maskedRequest) []string {
+	var diff []string
+	change := func(name, from, to string) {
+		if from != to {
+			diff = append(diff, fmt.Sprintf("%s: %q -> %q", name, from, to))
+		}
+	}
+	change("method", last.Method, current.Method)
+	lastUrl, lastErr := url.Parse(last.Url)
+	currentUrl, currentErr := url.Parse(current.Url)
+	if lastErr != nil || currentErr != nil {
+		change("url", last.Url, current.Url)
+	} else {
+		lastQuery, currentQuery := lastUrl.Query(), currentUrl.Query()
+		lastUrl.RawQuery, currentUrl.RawQuery = "", ""
+		change("url", lastUrl.String(), currentUrl.String())
+		var names []string
+		for name := range lastQuery {
+			names = append(names, name)
+		}
+		for name := range currentQuery {
+			if _, ok := lastQuery[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			change(name, strings.Join(lastQuery[name], ","), strings.Join(currentQuery[name], ","))
+		}
+	}
+	change("body", last.Body, current.Body)
+	return diff
+}
+
+// endregion
+
+// region Provider Locks
+// Locks to serialize requests to providers with "serialize": true
+type ProviderLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var providerLocks = &ProviderLocks{locks: map[string]*sync.Mutex{}}
+
+// Blocks until no other request to the same provider host and account is in flight, returns the unlock function
+func (l *ProviderLocks) Lock(p Provider) func() {
+	key := p.Username + "@" + uriTemplateHost(p.Uri)
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[key] = lock
+	}
+	l.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Returns the host of a provider URI template without scheme, userinfo, port and path.
+// url.Parse can't be used, because placeholders like <passwd> are not valid in the userinfo.
+func uriTemplateHost(uri string) string {
+	host := uri
+	if _, rest, found := strings.Cut(host, "://"); found {
+		host = rest
+	}
+	if idx := strings.IndexAny(host, "/?#"); idx >= 0 {
+		host = host[:idx]
+	}
+	if idx := strings.LastIndex(host, "@"); idx >= 0 {
+		host = host[idx+1:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// endregion
+
+// region Health Check Targets
+// Checks that the health check URL is an absolute http(s) URL without credentials and placeholders,
+// because it is probed without the update data
+func validateHealthCheckUrl(rawUrl string) error {
+	if strings.ContainsAny(rawUrl, "<>") {
+		return fmt.Errorf("placeholders are not supported: %s", rawUrl)
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL: %s", rawUrl)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host: %s", rawUrl)
+	}
+	if u.User != nil {
+		return fmt.Errorf("must not contain credentials")
+	}
+	return nil
+}
+
+// Returns the indexes of the providers that are probed by the deep health check:
+// the providers with health_check, or all providers if none has it. Disabled providers are never probed.
+func healthCheckProviders(providers []Provider) []int {
+	var selected, all []int
+	for i, p := range providers {
+		if !p.IsEnabled() {
+			continue
+		}
+		all = append(all, i)
+		if p.HealthCheck {
+			selected = append(selected, i)
+		}
+	}
+	if len(selected) == 0 {
+		return all
+	}
+	return selected
+}
+
+// Result of the deep health check
+type DeepHealth struct {
+	Status    string           `json:"status"` // "ok" if all probed providers are reachable, otherwise "degraded"
+	CheckedAt time.Time        `json:"checked_at"`
+	Providers []ProviderHealth `json:"providers"`
+}
+
+// Reachability of a single provider, without credentials and update data
+type ProviderHealth struct {
+	Index      int    `json:"index"`
+	Host       string `json:"host"`
+	Reachable  bool   `json:"reachable"`
+	HttpStatus int    `json:"http_status,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Minimum interval between two deep health checks, more frequent probes get the last result,
+// so the unauthenticated endpoint can't be used to flood the providers
+const deepHealthMinInterval = 10 * time.Second
+
+// Serializes the deep health checks and keeps the last result
+type DeepHealthChecker struct {
+	mu   sync.Mutex
+	last *DeepHealth
+}
+
+var deepHealth = &DeepHealthChecker{}
+
+// Returns the last result if it is recent, otherwise probes the providers concurrently within HEALTH_CHECK_TIMEOUT_MS
+func (d *DeepHealthChecker) Check(config *Config) DeepHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last != nil && clock.Now().Sub(d.last.CheckedAt) < deepHealthMinInterval {
+		return *d.last
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.HealthCheckTimeoutMs)*time.Millisecond)
+	defer cancel()
+	indexes := healthCheckProviders(config.Providers)
+	health := DeepHealth{Status: "ok", CheckedAt: clock.Now().UTC(), Providers: make([]ProviderHealth, len(indexes))}
+	var wg sync.WaitGroup
+	for n, i := range indexes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			health.Providers[n] = probeProvider(ctx, config, i, config.Providers[i])
+		}()
+	}
+	wg.Wait()
+	for _, provider := range health.Providers {
+		if !provider.Reachable {
+			health.Status = "degraded"
+		}
+	}
+	d.last = &health
+	return health
+}
+
+// Sends a HEAD request to the health check URL of a provider. Any HTTP response means reachable,
+// also an error status, as the URL isn't an update URL. No credentials, placeholders or forwarded headers are sent.
+func probeProvider(ctx context.Context, config *Config, index int, p Provider) ProviderHealth {
+	probeUrl := healthCheckUrl(p)
+	health := ProviderHealth{Index: index, Host: uriTemplateHost(probeUrl)}
+	start := clock.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, probeUrl, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	req.Header.Set("User-Agent", buildUserAgent(config.UserAgent, ""))
+	client := config.HttpClient
+	if p.HttpClient != nil {
+		client = p.HttpClient
+	}
+	resp, err := client.Do(req)
+	health.DurationMs = clock.Now().Sub(start).Milliseconds()
+	if err != nil {
+		health.Error = maskUrlError(err, probeUrl).Error()
+		log.Printf("[HEALTH] Index=%d URL=%s Unreachable: %s\n", index, probeUrl, health.Error)
+		return health
+	}
+	resp.Body.Close()
+	health.Reachable = true
+	health.HttpStatus = resp.StatusCode
+	return health
+}
+
+// Returns the URL that is probed for the provider: health_check_url, or the scheme and host of uri
+// without credentials, path and query, so no update data is sent
+func healthCheckUrl(p Provider) string {
+	if p.HealthCheckUrl != "" {
+		return p.HealthCheckUrl
+	}
+	scheme, rest, found := strings.Cut(p.Uri, "://")
+	if !found {
+		scheme, rest = "https", p.Uri
+	}
+	if idx := strings.IndexAny(rest, "/?#"); idx >= 0 {
+		rest = rest[:idx]
+	}
+	if idx := strings.LastIndex(rest, "@"); idx >= 0 {
+		rest = rest[idx+1:]
+	}
+	return scheme + "://" + rest + "/"
+}
+
+// endregion
+
+// region Forward Headers
+// Headers that must never be forwarded to providers
+var forbiddenForwardHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "Host"}
+
+// Checks that no header name is empty or forbidden
+func validateForwardHeaders(names []string) error {
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty header name")
+		}
+		for _, forbidden := range forbiddenForwardHeaders {
+			if strings.EqualFold(name, forbidden) {
+				return fmt.Errorf("header %s must not be forwarded", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the header value should never be logged in clear
+func isSensitiveHeader(name string) bool {
+	lower := strings.ToLower(name)
+	for _, part := range []string{"auth", "token", "key", "secret", "pass", "session", "cookie"} {
+		if strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copies the allowlisted headers of the client request to the provider request.
+// The allowlist of the provider takes precedence over FORWARD_HEADERS.
+func forwardHeaders(config *Config, index int, p Provider, clientReq *http.Request, providerReq *http.Request, plog *ProviderLog) {
+	names := config.ForwardHeaders
+	if p.ForwardHeaders != nil {
+		names = p.ForwardHeaders
+	}
+	for _, name := range names {
+		values := clientReq.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		providerReq.Header.Del(name)
+		for _, value := range values {
+			providerReq.Header.Add(name, value)
+		}
+		if debugEnabled(config) {
+			logValue := strings.Join(values, ", ")
+			if isSensitiveHeader(name) {
+				logValue = "*****"
+			}
+			plog.Verbosef("[FORWARD] Index=%d Header=%s Value=%s\n", index, name, logValue)
+		}
+	}
+}
+
+// endregion
+
+// region User-Agent Helper
+const maxUserAgentLength = 256
+
+// Build metadata of the application, set at build time via -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Default User-Agent of the provider requests, e.g. "dyndns-multiplexer/1.2.3"
+func defaultUserAgent() string {
+	return "dyndns-multiplexer/" + version
+}
+
+// Removes control characters and caps the length of a User-Agent value
+func sanitizeUserAgent(userAgent string) string {
+	userAgent = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, userAgent)
+	userAgent = strings.TrimSpace(userAgent)
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return userAgent
+}
+
+// Builds the outbound User-Agent from the template, <useragent> is replaced by the User-Agent of the client
+func buildUserAgent(template string, clientUserAgent string) string {
+	return sanitizeUserAgent(strings.ReplaceAll(template, "<useragent>", sanitizeUserAgent(clientUserAgent)))
+}
+
+// endregion
+
+// region Log Helper
+// maskDomain reduces a domain to its top-level domain and a short hash,
+// e.g. "*****.de#1a2b3c4d". The hash allows correlating log lines without revealing the domain.
+func maskDomain(domain string) string {
+	if domain == "" {
+		return ""
+	}
+	tld := ""
+	if idx := strings.LastIndex(strings.TrimSuffix(domain, "."), "."); idx >= 0 {
+		tld = strings.TrimSuffix(domain, ".")[idx:]
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(domain)))
+	return "*****" + tld + "#" + hex.EncodeToString(sum[:4])
+}
+
+// logDomain returns the domain as it should appear in log lines.
+// The domain is masked if LOG_MASK_DOMAIN is enabled, unless verbose logging is enabled.
+func logDomain(config *Config, domain string) string {
+	if config != nil && config.LogMaskDomain && !config.LogVerbose {
+		return maskDomain(domain)
+	}
+	return domain
+}
+
+// logDomainsIn returns a text for log lines, e.g. a response body or a header value, with every occurrence
+// of the domains masked like logDomain. Domains are matched case-insensitively.
+func logDomainsIn(config *Config, text string, domains ...string) string {
+	for _, domain := range domains {
+		if masked := logDomain(config, domain); domain != "" && masked != domain {
+			text = regexp.MustCompile(`(?i)`+regexp.QuoteMeta(domain)).ReplaceAllLiteralString(text, masked)
+		}
+	}
+	return text
+}
+
+// Returns the client address of a request for log lines. Behind a reverse proxy (TRUST_PROXY),
+// it is the right-most entry of X-Forwarded-For, which was added by the proxy, or X-Real-IP.
+// Otherwise, or without a valid header, it is r.RemoteAddr, so clients can't spoof the logged address.
+func requestorAddr(config *Config, r *http.Request) string {
+	if config == nil || !config.TrustProxy {
+		return r.RemoteAddr
+	}
+	forwardedFor := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	if forwardedFor != "" {
+		entries := strings.Split(forwardedFor, ",")
+		if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1])); ip != nil {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// Routes the standard logger through logWriter, which filters the lines by level and writes them
+// as text or as JSON objects (format "json"). The lines of the standard logger and of debugLogger go through
+// the same writer, so masking (e.g. of the provider URL) is the same for all formats and levels.
+func setupLogging(format string, level string) {
+	minLevel, ok := parseLogLevel(level)
+	if !ok {
+		minLevel = slog.LevelInfo
+	}
+	writer := &logWriter{out: os.Stderr, minLevel: minLevel}
+	if strings.ToLower(strings.TrimSpace(format)) == "json" {
+		writer.json = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: minLevel}))
+	}
+	log.SetFlags(0)
+	log.SetOutput(writer)
+}
+
+// Returns the slog level for LOG_LEVEL: error, warn, info or debug
+func parseLogLevel(level string) (slog.Level, bool) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "error":
+		return slog.LevelError, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "info", "":
+		return slog.LevelInfo, true
+	case "debug":
+		return slog.LevelDebug, true
+	}
+	return slog.LevelInfo, false
+}
+
+// Returns true if debug lines are logged, i.e. with LOG_LEVEL debug or LOG_VERBOSE, as they may contain sensitive information
+func debugEnabled(config *Config) bool {
+	return config != nil && (config.LogLevel == "debug" || config.LogVerbose)
+}
+
+// Logs a line with level debug via debugLogger, only if debug lines are enabled
+func logVerbosef(config *Config, format string, args ...any) {
+	if debugEnabled(config) {
+		debugLogger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// Logger of the debug lines. Its handler writes the records through the writer of the standard logger,
+// so they are filtered by LOG_LEVEL, formatted by LOG_FORMAT and keep their order with the other lines.
+var debugLogger = slog.New(logHandler{})
+
+// slog handler that writes the records through logWriter. The debug lines have no attributes, so they are ignored.
+type logHandler struct{}
+
+func (logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if w, ok := log.Writer().(*logWriter); ok {
+		return level >= w.minLevel
+	}
+	return true
+}
+
+func (logHandler) Handle(_ context.Context, record slog.Record) error {
+	if w, ok := log.Writer().(*logWriter); ok {
+		return w.writeLine(record.Level, record.Message)
+	}
+	// Before setupLogging, or if the output was replaced, the record is a text line with the level
+	log.Print("[" + record.Level.String() + "] " + strings.TrimRight(record.Message, "\r\n"))
+	return nil
+}
+
+func (h logHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h logHandler) WithGroup(string) slog.Handler      { return h }
+
+// Log lines of a provider during an update. If buffered, the lines are kept until Flush,
+// so the lines of concurrently updated providers don't interleave. Otherwise they are logged immediately.
+type ProviderLog struct {
+	Buffered bool
+	Config   *Config // config of the request, for LOG_LEVEL and LOG_VERBOSE
+	mu       sync.Mutex
+	lines    []providerLogLine
+}
+
+// Buffered line of a ProviderLog
+type providerLogLine struct {
+	debug bool // logged via debugLogger
+	text  string
+}
+
+// Logs a line like log.Printf, a nil ProviderLog logs immediately
+func (l *ProviderLog) Printf(format string, args ...any) {
+	if l == nil || !l.Buffered {
+		log.Printf(format, args...)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, providerLogLine{text: fmt.Sprintf(format, args...)})
+}
+
+// Logs a line like logVerbosef, only if debug lines are enabled
+func (l *ProviderLog) Verbosef(format string, args ...any) {
+	if l == nil || !debugEnabled(l.Config) {
+		return
+	}
+	if !l.Buffered {
+		debugLogger.Debug(fmt.Sprintf(format, args...))
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, providerLogLine{debug: true, text: fmt.Sprintf(format, args...)})
+}
+
+// Logs the buffered lines together
+func (l *ProviderLog) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if line.debug {
+			debugLogger.Debug(line.text)
+		} else {
+			log.Print(line.text)
+		}
+	}
+	l.lines = nil
+}
+
+// Writes the lines of the standard logger and the records of debugLogger. The level of a line of the standard logger
+// is derived from its prefix: [ERROR] and [PANIC] are errors, [WARNING], [TIMEOUT] and [STALE] are warnings, all others are info.
+// Debug lines are written with the prefix [DEBUG] in the text format.
+// With JSON, a line like "[RESPONSE] Index=0 URL=... Status=200 Body=good" is converted into an object
+// with the fields level, event, provider_index, url, status_code, return_code and msg.
+type logWriter struct {
+	out      io.Writer
+	json     *slog.Logger // nil for the text format
+	minLevel slog.Level
+	mu       sync.Mutex // the standard logger and debugLogger write concurrently
+}
+
+var (
+	logEventPattern      = regexp.MustCompile(`^\[([A-Za-z-]+)\]\s*`)
+	logIndexPattern      = regexp.MustCompile(`\bIndex=(\d+)`)
+	logUrlPattern        = regexp.MustCompile(`\bURL=(\S+)`)
+	logStatusPattern     = regexp.MustCompile(`\bStatus=(\d+)`)
+	logReturnCodePattern = regexp.MustCompile(`(?:Matched return code: |\bCode=)(\S+)`)
+)
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	line := string(b)
+	level := slog.LevelInfo
+	if m := logEventPattern.FindStringSubmatch(line); m != nil {
+		switch strings.ToLower(m[1]) {
+		case "error", "panic":
+			level = slog.LevelError
+		case "warning", "timeout", "cancelled", "stale":
+			level = slog.LevelWarn
+		}
+	}
+	return len(b), w.writeLine(level, line)
+}
+
+// Writes a line with the level, unless the level is below the minimum level
+func (w *logWriter) writeLine(level slog.Level, line string) error {
+	if level < w.minLevel {
+		return nil
+	}
+	line = strings.TrimRight(line, "\r\n")
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.json == nil {
+		if level < slog.LevelInfo {
+			line = "[DEBUG] " + line
+		}
+		_, err := fmt.Fprintf(w.out, "%s %s\n", clock.Now().Format("2006/01/02 15:04:05"), line)
+		return err
+	}
+
+	msg := line
+	event := ""
+	if m := logEventPattern.FindStringSubmatch(msg); m != nil {
+		event = strings.ToLower(m[1])
+		msg = msg[len(m[0]):]
+	}
+
+	var attrs []slog.Attr
+	if event != "" {
+		attrs = append(attrs, slog.String("event", event))
+	}
+	if m := logIndexPattern.FindStringSubmatch(msg); m != nil {
+		index, _ := strconv.Atoi(m[1])
+		attrs = append(attrs, slog.Int("provider_index", index))
+	}
+	if m := logUrlPattern.FindStringSubmatch(msg); m != nil {
+		attrs = append(attrs, slog.String("url", strings.TrimSuffix(m[1], ",")))
+	}
+	if m := logStatusPattern.FindStringSubmatch(msg); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		attrs = append(attrs, slog.Int("status_code", status))
+	}
+	if m := logReturnCodePattern.FindStringSubmatch(msg); m != nil {
+		attrs = append(attrs, slog.String("return_code", m[1]))
+	}
+	// The record is created with the time of the clock, like the text format
+	record := slog.NewRecord(clock.Now(), level, msg, 0)
+	record.AddAttrs(attrs...)
+	return w.json.Handler().Handle(context.Background(), record)
+}
+
+// endregion
+
+func dyndnsHandler(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	// Continue an incoming trace, the span is a no-op if tracing is disabled
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "update", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	log.Printf("[REQUESTOR] %s RequestID=%s\n", requestorAddr(config, r), requestIdFromContext(r.Context()))
+	if err := currentConfigError(); err != nil {
+		responseWithError(w, http.StatusInternalServerError, "911", "UNHEALTHY: config error. "+err.Error())
+		return
+	}
+
+	query, err := ParseQueryParams(config, r)
+	if err != nil {
+		// All problems are logged, but the response only lists all of them in verbose mode or for admins
+		message := validationErrorMessage(err, config.LogVerbose || isAdminRequest(config, r))
+		if details := validationErrorMessage(err, true); details != message {
+			log.Println("[ERROR] " + details)
+		}
+		if errors.Is(err, errMissingCredentials) {
+			// Tell clients that support it to send the credentials via HTTP Basic Auth
+			w.Header().Set("WWW-Authenticate", `Basic realm="dyndns-multiplexer"`)
+			responseWithError(w, http.StatusUnauthorized, "badauth", "[ERROR] "+message)
+			return
+		}
+		responseWithError(w, http.StatusBadRequest, "badauth", "[ERROR] "+message)
+		return
+	} else if debugEnabled(config) {
+		// Logged after parsing, so oversized query params are never logged
+		logVerbosef(config, "[REQUESTOR] Full URL: %s\n", loggingRequestUrl(r.URL))
+		if query.Ip6LanNetwork != nil {
+			logVerbosef(config, "[REQUEST] Parsed Ip6LanNetwork: %s\n", query.Ip6LanNetwork.String())
+		}
+	}
+
+	// Check if query params match config
+	userKnown, passwordValid := checkCredentials(config, query.Username, query.Password)
+	if !userKnown || !passwordValid {
+		if !userKnown {
+			log.Println("[AUTH] Unknown username")
+		} else {
+			log.Println("[AUTH] Known username with wrong password")
+		}
+		if debugEnabled(config) {
+			if query.Username != config.Username {
+				logVerbosef(config, "query.Username=%s, expected=%s", query.Username, config.Username)
+			}
+			// Neither the sent nor the configured password is logged, also with LOG_VERBOSE
+			if userKnown && !passwordValid {
+				logVerbosef(config, "query.Password=*****, doesn't match the configured password")
+			}
+		}
+		responseWithError(w, http.StatusUnauthorized, "badauth", "[ERROR] Query parameters do not match configuration")
+		return
+	}
+	if query.Domain != config.Domain {
+		if debugEnabled(config) {
+			if query.Domain != config.Domain {
+				logVerbosef(config, "query.Domain=%s, expected=%s", query.Domain, config.Domain)
+			}
+		}
+		responseWithError(w, http.StatusUnauthorized, "nohost", "[ERROR] Domain does not match configuration")
+		return
+	}
+
+	if len(config.Providers) == 0 {
+		responseWithError(w, http.StatusServiceUnavailable, "911", "[ERROR] No providers configured")
+		return
+	}
+	warnUnusedLanPrefixes(query, config.Providers)
+
+	tracker := NewStatusTracker(query.IpAddr, responseIp6(config, query.Ip6Addr), config.SeverityMap)
+	counters.RecordUpdate()
+	updateRequestsTotal.Inc()
+	var verifications []string // DNS verification results, "<index>=<result>"
+
+	// Update all providers concurrently, limited by MAX_CONCURRENCY.
+	// The results are stored by provider index, so the aggregated status doesn't depend on the completion order.
+	results := make([]ProviderResult, len(config.Providers))
+	// With LOG_GROUP_BY_PROVIDER, the log lines of each provider are written together after all providers are done
+	plogs := make([]*ProviderLog, len(config.Providers))
+	for i := range plogs {
+		plogs[i] = &ProviderLog{Buffered: config.LogGroupByProvider, Config: config}
+	}
+	var semaphore chan struct{}
+	if config.MaxConcurrency > 0 {
+		semaphore = make(chan struct{}, config.MaxConcurrency)
+	}
+	inFlightKey := inFlightUpdates.Start(requestIdFromContext(r.Context()), config.Providers)
+	defer inFlightUpdates.Finish(inFlightKey)
+	if config.ProviderStrategy == "failover" {
+		// Failover: the providers are updated one after another in order, until one succeeds. The others are skipped.
+		succeeded := -1
+		for i, p := range config.Providers {
+			if succeeded >= 0 {
+				plogs[i].Printf("[SKIPPED] Index=%d Failover, provider at index %d succeeded\n", i, succeeded)
+				results[i] = ProviderResult{Index: i, Host: uriTemplateHost(p.Uri), Skipped: true}
+				inFlightUpdates.ProviderDone(inFlightKey, i)
+				continue
+			}
+			results[i] = updateProvider(ctx, config, i, p, query, r, tracker, plogs[i])
+			inFlightUpdates.ProviderDone(inFlightKey, i)
+			if !results[i].Skipped && tracker.IsSuccess(results[i].Code) {
+				succeeded = i
+			}
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i, p := range config.Providers {
+			wg.Go(func() {
+				if semaphore != nil {
+					semaphore <- struct{}{}
+					defer func() { <-semaphore }()
+				}
+				results[i] = updateProvider(ctx, config, i, p, query, r, tracker, plogs[i])
+				inFlightUpdates.ProviderDone(inFlightKey, i)
+			})
+		}
+		wg.Wait()
+	}
+	for _, plog := range plogs {
+		plog.Flush()
+	}
+
+	responseIpSet := false
+	for _, result := range results {
+		if result.Skipped {
+			continue
+		}
+		if result.Code == "timeout" {
+			tracker.CheckTimeout()
+		} else if result.Code == "cancelled" {
+			tracker.CheckCancelled()
+		} else {
+			tracker.CheckStatus(result.Code, true)
+		}
+		// The first provider with response_ip_source "body" determines the echoed IP
+		if result.ResponseIp != "" && !responseIpSet {
+			tracker.SetResponseIp(result.ResponseIp)
+			responseIpSet = true
+		}
+		if result.Verification != "" {
+			verifications = append(verifications, fmt.Sprintf("%d=%s", result.Index, result.Verification))
+		}
+	}
+
+	// With failover, the provider that succeeded determines the status, the failed providers before it are only counted
+	if config.ProviderStrategy == "failover" {
+		if i := slices.IndexFunc(results, func(result ProviderResult) bool { return !result.Skipped && tracker.IsSuccess(result.Code) }); i >= 0 {
+			tracker.UseStatus(results[i].Code)
+		}
+	}
+
+	if config.SuccessConditionExpr != nil {
+		tracker.ApplySuccessCondition(config.SuccessConditionExpr)
+	}
+
+	// A final nochg echoes the address reported by the first nochg provider, as the request IP may not be what the providers have
+	if tracker.HeaderStatus == "nochg" && !responseIpSet {
+		for _, result := range results {
+			if !result.Skipped && result.NochgIp != "" {
+				tracker.SetResponseIp(result.NochgIp)
+				break
+			}
+		}
+	}
+
+	updateStatus.Record(tracker, results)
+	if config.LastResultFile != "" {
+		lastResult.Save(config.LastResultFile, newLastResult(requestIdFromContext(r.Context()), tracker, results))
+	}
+
+	// Optional delay, so DNS can propagate before the client checks the update
+	if config.ResponseDelayMs > 0 {
+		logVerbosef(config, "[DELAY] Waiting %d ms before response\n", config.ResponseDelayMs)
+		clock.Sleep(time.Duration(config.ResponseDelayMs) * time.Millisecond)
+	}
+
+	span.SetAttributes(attribute.String("dyndns.return_code", tracker.HeaderStatus))
+	// A passthrough provider that responded determines the response, its status, Content-Type and body are returned unchanged,
+	// without the aggregated headers. Otherwise, e.g. if it was skipped or didn't respond, the aggregated status is returned as usual.
+	for i, result := range results {
+		if config.Providers[i].Passthrough && result.HttpStatus != 0 {
+			// nil suppresses the detected Content-Type if the provider didn't send one
+			w.Header()["Content-Type"] = nil
+			if result.ContentType != "" {
+				w.Header().Set("Content-Type", result.ContentType)
+			}
+			w.WriteHeader(result.HttpStatus)
+			io.WriteString(w, result.Body)
+			return
+		}
+	}
+	if len(verifications) > 0 {
+		w.Header().Set("X-DNS-Verification", strings.Join(verifications, ", "))
+	}
+	setProviderCountHeaders(w, tracker.Total, tracker.Succeeded, tracker.Failed)
+	w.Header().Set(tracker.HeaderStatus, tracker.FinalStatus)
+	jsonResponse := wantsJsonResponse(r)
+	if jsonResponse {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if config.StrictHttpStatus {
+		w.WriteHeader(httpStatusOf(tracker))
+	}
+	if jsonResponse {
+		json.NewEncoder(w).Encode(newUpdateResponse(tracker, results))
+		return
+	}
+	fmt.Fprintln(w, tracker.FinalStatus)
+}
+
+// Returns the HTTP status for the aggregated return code with STRICT_HTTP_STATUS, for clients that only check the HTTP status
+func httpStatusOf(tracker *StatusTracker) int {
+	switch tracker.HeaderStatus {
+	case "badauth":
+		return http.StatusUnauthorized
+	case "!yours", "!donator", "abuse":
+		return http.StatusForbidden
+	case "nohost":
+		return http.StatusNotFound
+	case "notfqdn", "numhost", "badagent":
+		return http.StatusBadRequest
+	}
+	if tracker.IsSuccess(tracker.HeaderStatus) {
+		return http.StatusOK
+	}
+	// 911, dnserr, unknown and custom failure codes of SEVERITY_MAP: a provider failed
+	return http.StatusBadGateway
+}
+
+// Structured response of /update for clients that request JSON
+type UpdateResponse struct {
+	Status     string             `json:"status"`                // return code of the final status, e.g. "good"
+	ResponseIp string             `json:"response_ip,omitempty"` // IP addresses of good and nochg, as in the DynDNS line
+	Total      int                `json:"total"`
+	Succeeded  int                `json:"succeeded"`
+	Failed     int                `json:"failed"`
+	Providers  []ProviderResponse `json:"providers"`
+}
+
+// Result of a single provider in the JSON response, without URL and credentials
+type ProviderResponse struct {
+	Index        int    `json:"index"`
+	Host         string `json:"host"`
+	Skipped      bool   `json:"skipped,omitempty"`
+	Code         string `json:"code,omitempty"`
+	HttpStatus   int    `json:"http_status,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+	Verification string `json:"verification,omitempty"`
+}
+
+// Collects the JSON response from the tracker and the provider results
+func newUpdateResponse(tracker *StatusTracker, results []ProviderResult) UpdateResponse {
+	response := UpdateResponse{
+		Status:    tracker.HeaderStatus,
+		Total:     tracker.Total,
+		Succeeded: tracker.Succeeded,
+		Failed:    tracker.Failed,
+		Providers: make([]ProviderResponse, 0, len(results)),
+	}
+	if tracker.HeaderStatus == "good" || tracker.HeaderStatus == "nochg" {
+		response.ResponseIp = tracker.ResponseIp
+	}
+	for _, result := range results {
+		response.Providers = append(response.Providers, ProviderResponse{
+			Index:        result.Index,
+			Host:         result.Host,
+			Skipped:      result.Skipped,
+			Code:         result.Code,
+			HttpStatus:   result.HttpStatus,
+			DurationMs:   result.DurationMs,
+			Verification: result.Verification,
+		})
+	}
+	return response
+}
+
+// Returns true if the client requests a JSON response with ?format=json or the header "Accept: application/json"
+func wantsJsonResponse(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.EqualFold(format, "json")
+	}
+	return strings.Contains(strings.ToLower(r.Header.Get("Accept")), "application/json")
+}
+
+// Logs a warning if the request has a LAN prefix, but no provider combines it with an interface ID,
+// which likely indicates a mismatch between the client and the provider config
+func warnUnusedLanPrefixes(query *QueryParams, providers []Provider) {
+	iid6Used, iid4Used := false, false
+	for _, p := range providers {
+		if !p.IsEnabled() {
+			continue
+		}
+		iid6Used = iid6Used || p.Iid6Masked != nil
+		iid4Used = iid4Used || p.Iid4Masked != nil
+	}
+	if query.Ip6LanNetwork != nil && !iid6Used {
+		log.Println("[WARNING] ip6lanprefix was sent, but no provider has iid6 or macs to combine it with, it is only used for <ip6lanprefix>")
+	}
+	if query.Ip4LanNetwork != nil && !iid4Used {
+		log.Println("[WARNING] ip4lanprefix was sent, but no provider has iid4 to combine it with, it is only used for <ip4lanprefix>")
+	}
+}
+
+// Result of a single provider update
+type ProviderResult struct {
+	Index        int
+	Host         string // host of the provider uri, without credentials
+	HttpStatus   int    // HTTP status of the last response, 0 if there is no response
+	DurationMs   int64  // duration of the provider update including retries
+	Skipped      bool   // the provider was not contacted, e.g. because of a when condition
+	Code         string // matched return code, "timeout" if the provider didn't respond in time
+	Verification string // result of the DNS verification, empty if not verified
+	ResponseIp   string // IP addresses parsed from the response body, if response_ip_source is "body"
+	NochgIp      string // IP addresses parsed from the response body of a nochg result
+	Body         string // response body of the last response, only set for providers with passthrough
+	ContentType  string // Content-Type of the last response, only set for providers with passthrough
+}
+
+// Sends the update to a single provider. It is called concurrently for all providers,
+// so it must not modify the tracker; the result is recorded by the caller in provider order.
+func updateProvider(ctx context.Context, config *Config, i int, p Provider, query *QueryParams, r *http.Request, tracker *StatusTracker, plog *ProviderLog) ProviderResult {
+	result := ProviderResult{Index: i, Host: uriTemplateHost(p.Uri)}
+	if !p.IsEnabled() {
+		plog.Printf("[SKIPPED] Index=%d Disabled\n", i)
+		result.Skipped = true
+		return result
+	}
+
+	if p.WhenConditions != nil && !MatchWhenConditions(p.WhenConditions, query) {
+		plog.Printf("[SKIPPED] Index=%d Condition not met: %s\n", i, p.When)
+		result.Skipped = true
+		return result
+	}
+
+	if query.Offline && !supportsOffline(p) {
+		// Without <offline>, the provider would get an update without an address and might use the source IP of the request
+		plog.Printf("[SKIPPED] Index=%d Offline request, but the provider has no <offline> placeholder\n", i)
+		result.Skipped = true
+		return result
+	}
+
+	if !hasFamilyAddress(p, query) {
+		plog.Printf("[SKIPPED] Index=%d No address for family %s in the request\n", i, p.Family)
+		result.Skipped = true
+		return result
+	}
+
+	if p.ActiveWindowParsed != nil && !p.ActiveWindowParsed.Contains(clock.Now()) {
+		plog.Printf("[SKIPPED] Index=%d Outside of active window: %s\n", i, p.ActiveWindow)
+		result.Skipped = true
+		return result
+	}
+
+	if next, paced := updatePacing.NextUpdate(i); paced {
+		plog.Printf("[SKIPPED] Index=%d Next update allowed at %s\n", i, next.Format(time.RFC3339))
+		result.Skipped = true
+		return result
+	}
+
+	_, providerSpan := tracer.Start(ctx, "provider", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.Int("provider.index", i)))
+	providerStart := clock.Now()
+	defaultCode := "unknown"
+	if p.DefaultCode != "" {
+		defaultCode = p.DefaultCode
+	}
+	// Matches the result and finishes the provider span
+	checkStatus := func(providerResult string, exactReturnCodeMatch bool) string {
+		code := tracker.MatchStatus(providerResult, exactReturnCodeMatch, defaultCode)
+		result.Code = code
+		result.DurationMs = clock.Now().Sub(providerStart).Milliseconds()
+		counters.RecordProvider(i, tracker.IsSuccess(code))
+		recordProviderMetric(p, code)
+		providerSpan.SetAttributes(
+			attribute.String("dyndns.return_code", code),
+			attribute.Int64("duration_ms", clock.Now().Sub(providerStart).Milliseconds()),
+		)
+		providerSpan.End()
+		return code
+	}
+	// Records a provider without a response, code is "timeout" or "cancelled"
+	checkNoResponse := func(code string) {
+		result.Code = code
+		result.DurationMs = clock.Now().Sub(providerStart).Milliseconds()
+		counters.RecordProvider(i, false)
+		recordProviderMetric(p, code)
+		providerSpan.SetAttributes(
+			attribute.String("dyndns.return_code", code),
+			attribute.Int64("duration_ms", clock.Now().Sub(providerStart).Milliseconds()),
+		)
+		providerSpan.End()
+	}
+
+	ipaddr, lazyWarning4, lazyError := resolveIpAddr(p, query)
+	ip6addr, lazyWarning, lazyError6 := resolveIp6Addr(p, query, plog)
+	if lazyError6 != nil {
+		lazyError6 = fmt.Errorf("provider at index %s has an iid6 that doesn't fit the ip6lanprefix of the request: %v", providerIndexLabel(config, p), lazyError6)
+	}
+	if lazyError == nil {
+		lazyError = lazyError6
+	}
+	values := placeholderValues(p, query, ipaddr, ip6addr)
+	uri, loggingUri := fillUriTemplate(config, p.Uri, values)
+	body, loggingBody := fillTemplate(config, p.Body, values, bodyEscaper(p.ContentType))
+	for _, warning := range []string{lazyWarning4, lazyWarning} {
+		if warning != "" {
+			plog.Printf("[WARNING] Index=%d URL=%s Warning=%s\n", i, loggingUri, warning)
+		}
+	}
+	// With IP_CACHE_TTL_S, a provider that already has the addresses is not contacted again, the result is nochg
+	cacheKey := ipCacheKey(i, p.Domain)
+	// An offline request is always sent, the cache only knows the addresses
+	if lazyError == nil && config.IpCacheTtlS > 0 && !query.Force && !query.Offline {
+		if pushed, unchanged := ipCache.Unchanged(cacheKey, ipaddr, ip6addr, time.Duration(config.IpCacheTtlS)*time.Second); unchanged {
+			plog.Printf("[CACHED] Index=%d URL=%s Addresses unchanged since %s, not sent\n", i, loggingUri, pushed.Format(time.RFC3339))
+			// Counted like a nochg response, so /status and the metrics include cached skips
+			providerSpan.SetAttributes(attribute.Bool("dyndns.cached", true))
+			checkStatus("nochg", true)
+			return result
+		}
+	}
+	if p.Body != "" {
+		plog.Printf("[REQUEST] Index=%d URL=%s Method=%s Body=%s\n", i, loggingUri, p.Method, loggingBody)
+	} else {
+		plog.Printf("[REQUEST] Index=%d URL=%s\n", i, loggingUri)
+	}
+	if debugEnabled(config) {
+		// Dry runs are compared with the last sent request, but not stored
+		current := maskedRequest{Method: p.Method, Url: loggingUri, Body: loggingBody}
+		if diff := lastRequests.Diff(i, current, !p.DryRun); len(diff) > 0 {
+			plog.Verbosef("[DIFF] Index=%d Changed since the last request: %s\n", i, strings.Join(diff, ", "))
+		}
+	}
+	if lazyError != nil {
+		plog.Printf("[ERROR] Index=%d URL=%s Error=%v\n", i, loggingUri, lazyError)
+		checkStatus("911", true)
+		return result
+	}
+
+	// Optional delay before request
+	if p.DelayMs > 0 {
+		plog.Verbosef("[DELAY] Index=%d URL=%s, Waiting %d ms before request\n", i, loggingUri, p.DelayMs)
+		clock.Sleep(time.Duration(p.DelayMs) * time.Millisecond)
+	}
+
+	// Send the request, retry on network errors and transient return codes with exponential backoff
+	var attempt providerAttempt
+	for n := 0; ; n++ {
+		attempt = sendProviderRequest(config, i, p, uri, loggingUri, body, r, tracker, providerSpan, plog)
+		if attempt.Err == nil && !attempt.Exact && p.SuccessWhenEchoesIp && echoesSentIp(attempt.Body, []string{ipaddr, ip6addr}) {
+			// Echo-style provider: the body is just the address that was set
+			plog.Printf("[RESPONSE] Index=%d URL=%s Body echoes the sent address, treated as good\n", i, loggingUri)
+			attempt.Result, attempt.Exact = "good", true
+		}
+		if attempt.Err == nil && p.CheckResponseIp && tracker.IsSuccess(tracker.MatchStatus(attempt.Result, attempt.Exact, defaultCode)) {
+			// A provider that silently failed may confirm the update with the previously stored IP
+			if stale := staleResponseIps(attempt.Body, []string{ipaddr, ip6addr}); len(stale) > 0 {
+				plog.Printf("[STALE] Index=%d URL=%s Response IP %s doesn't match the sent addresses, treated as unknown\n", i, loggingUri, strings.Join(stale, " "))
+				attempt.Result, attempt.Exact = "unknown", true
+			}
+		}
+		// Retries are pointless if the client disconnected
+		if n >= p.Retries || r.Context().Err() != nil || !isRetryable(p, attempt, tracker, defaultCode) {
+			break
+		}
+		backoff := retryBackoff(p, n)
+		plog.Printf("[RETRY] Index=%d URL=%s Attempt=%d/%d, Waiting %d ms before retry\n", i, loggingUri, n+2, p.Retries+1, backoff.Milliseconds())
+		select {
+		case <-clock.After(backoff):
+		case <-r.Context().Done():
+			// The client disconnected during the backoff, the last attempt is the result
+			plog.Printf("[CANCELLED] Index=%d URL=%s Client disconnected, retry cancelled\n", i, loggingUri)
+		}
+		if r.Context().Err() != nil {
+			break
+		}
+	}
+	result.HttpStatus = attempt.StatusCode
+	if p.Passthrough {
+		result.Body = attempt.Body
+		result.ContentType = attempt.Header.Get("Content-Type")
+	}
+	if attempt.Err != nil {
+		if isCancelled(r, attempt.Err) {
+			checkNoResponse("cancelled")
+		} else if isTimeout(attempt.Err) {
+			checkNoResponse("timeout")
+		} else {
+			checkStatus("911", true)
+		}
+		return result
+	}
+
+	code := checkStatus(attempt.Result, attempt.Exact)
+	// Only a successful update is paced, a failed one may be retried with the next request
+	if tracker.IsSuccess(code) && !p.DryRun {
+		updatePacing.Apply(i, p, attempt.Header, plog)
+	}
+	if config.IpCacheTtlS > 0 && !p.DryRun && tracker.IsSuccess(code) {
+		if query.Offline {
+			// The host is offline now, so the next update must be sent even with the same addresses
+			ipCache.Forget(cacheKey)
+		} else {
+			ipCache.Store(cacheKey, ipaddr, ip6addr)
+		}
+		if config.StateFile != "" {
+			ipCache.Save(config.StateFile)
+		}
+	}
+
+	if p.ResponseIpSource == "body" && tracker.IsSuccess(code) {
+		result.ResponseIp = parseResponseIp(config, attempt.Body)
+		plog.Verbosef("[RESPONSE] Index=%d Parsed response IP: %q\n", i, result.ResponseIp)
+	} else if code == "nochg" {
+		// The address that the provider still has, echoed if the final status is nochg
+		result.NochgIp = parseResponseIp(config, attempt.Body)
+		plog.Verbosef("[RESPONSE] Index=%d Parsed nochg IP: %q\n", i, result.NochgIp)
+	}
+
+	if p.VerifyDns && tracker.IsSuccess(code) {
+		verification := verifyDns(ctx, config, p.Domain, []string{ipaddr, ip6addr}, plog)
+		plog.Printf("[VERIFY] Index=%d Domain=%s Verification=%s\n", i, logDomain(config, p.Domain), verification)
+		result.Verification = verification
+	}
+	return result
+}
+
+// Placeholders that can be used as source of a param in params
+var paramPlaceholders = []string{"username", "passwd", "domain", "ipaddr", "ip6addr", "ip4lanprefix", "ip6lanprefix", "dualstack", "system", "offline"}
+
+// Appends a query param for each entry of params to the URI template, e.g. {"ipaddr": "myip"} appends "myip=<ipaddr>".
+// The params are sorted by name, so the URI is stable.
+func appendParams(uri string, params map[string]string) (string, error) {
+	names := make([]string, 0, len(params))
+	placeholders := map[string]string{}
+	for placeholder, name := range params {
+		if !slices.Contains(paramPlaceholders, placeholder) {
+			return "", fmt.Errorf("unknown placeholder %s (allowed: %s)", placeholder, strings.Join(paramPlaceholders, ", "))
+		}
+		if name == "" {
+			return "", fmt.Errorf("empty param name for placeholder %s", placeholder)
+		}
+		if _, ok := placeholders[name]; ok {
+			return "", fmt.Errorf("duplicate param name %s", name)
+		}
+		names = append(names, name)
+		placeholders[name] = placeholder
+	}
+	sort.Strings(names)
+
+	var query []string
+	for _, name := range names {
+		query = append(query, url.QueryEscape(name)+"=<"+placeholders[name]+">")
+	}
+	separator := "?"
+	if strings.Contains(uri, "?") {
+		separator = "&"
+		if strings.HasSuffix(uri, "?") || strings.HasSuffix(uri, "&") {
+			separator = ""
+		}
+	}
+	return uri + separator + strings.Join(query, "&"), nil
+}
+
+// Default transient return codes that are retried if retries is set
+var defaultRetryOn = []string{"911", "dnserr"}
+
+// Returns true if the attempt failed with a network error or a transient return code
+func isRetryable(p Provider, attempt providerAttempt, tracker *StatusTracker, defaultCode string) bool {
+	if attempt.Err != nil {
+		return true
+	}
+	// With retry_on_unknown, a response without a known return code is retried, even if default_code is set
+	if p.RetryOnUnknown && tracker.MatchStatus(attempt.Result, attempt.Exact, "unknown") == "unknown" {
+		return true
+	}
+	retryOn := defaultRetryOn
+	if p.RetryOn != nil {
+		retryOn = p.RetryOn
+	}
+	return slices.Contains(retryOn, tracker.MatchStatus(attempt.Result, attempt.Exact, defaultCode))
+}
+
+// Returns the delay before retry n+1: retry_backoff_ms * 2^n plus a jitter of up to 10%
+func retryBackoff(p Provider, n int) time.Duration {
+	backoffMs := 1000
+	if p.RetryBackoffMs > 0 {
+		backoffMs = p.RetryBackoffMs
+	}
+	backoff := time.Duration(backoffMs) * time.Millisecond << n
+	return backoff + mathrand.N(backoff/10+1)
+}
+
+// Value of a placeholder in the uri and body of a provider, e.g. {"ipaddr", "1.2.3.4"}
+type placeholderValue struct {
+	Name  string
+	Value string
+}
+
+// Returns false if the provider is restricted to an address family, but the request yields no address of it:
+// ipv4 needs ipaddr (or ip4lanprefix with iid4), ipv6 needs ip6addr (or ip6lanprefix with iid6/macs)
+func hasFamilyAddress(p Provider, query *QueryParams) bool {
+	if query.Offline {
+		// The host is marked offline for all families
+		return true
+	}
+	switch p.Family {
+	case "ipv4":
+		if p.Iid4Masked != nil {
+			return query.Ip4LanNetwork != nil
+		}
+		return query.IpAddr != ""
+	case "ipv6":
+		if p.Iid6Masked != nil {
+			return query.Ip6LanNetwork != nil
+		}
+		return query.Ip6Addr != ""
+	}
+	return true
+}
+
+// Returns true if the provider sends <offline> in its uri, body or params, so it can mark the host offline
+func supportsOffline(p Provider) bool {
+	if _, ok := p.Params["offline"]; ok {
+		return true
+	}
+	return strings.Contains(p.Uri, "<offline") || strings.Contains(p.Body, "<offline")
+}
+
+// Returns the value of <ipaddr> for a provider: ip4lanprefix + iid4 if the provider has an IID4, otherwise the ipaddr of the request.
+// The warning is set if the provider has an IID4, but the request has no ip4lanprefix.
+func resolveIpAddr(p Provider, query *QueryParams) (string, string, error) {
+	if p.Iid4Masked == nil {
+		return query.IpAddr, "", nil
+	}
+	if query.Ip4LanNetwork == nil {
+		return "", "Provider requires IID4, but no ip4lanprefix was provided in the request. Using empty ipaddr for request.", nil
+	}
+	ipaddr, err := combinePrefixAndIID4(*query.Ip4LanNetwork, p.Iid4Masked)
+	return ipaddr, "", err
+}
+
+// Returns the value of <ip6addr> for a provider: ip6lanprefix + iid6 if the provider has an IID6, otherwise the ip6addr of the request.
+// The warning is set if the provider has an IID6, but the request has no ip6lanprefix.
+func resolveIp6Addr(p Provider, query *QueryParams, plog *ProviderLog) (string, string, error) {
+	if p.Iid6Masked == nil {
+		return query.Ip6Addr, "", nil
+	}
+	if query.Ip6LanNetwork == nil {
+		return "", "Provider requires IID6, but no ip6lanprefix was provided in the request. Using empty ip6addr for request.", nil
+	}
+	ip6addr, err := combinePrefixAndIID6(*query.Ip6LanNetwork, p.Iid6Masked)
+	if (ip6addr != "") && (err != nil) {
+		plog.Verbosef("[REQUEST] Parsed Ip6LanNetwork: %s\n", query.Ip6LanNetwork.String())
+	}
+	return ip6addr, "", err
+}
+
+// Returns the values of all placeholders of a provider for a request
+func placeholderValues(p Provider, query *QueryParams, ipaddr string, ip6addr string) []placeholderValue {
+	return append([]placeholderValue{
+		{"ipaddr", ipaddr},
+		{"ip6addr", ip6addr},
+		{"ip4lanprefix", query.Ip4LanPrefix},
+		{"ip6lanprefix", query.Ip6LanPrefix},
+		{"dualstack", query.Dualstack},
+		{"system", query.System},
+		{"offline", query.OfflineValue()},
+		{"domain", p.Domain},
+		{"username", p.Username},
+		{"passwd", p.Password},
+	}, p.EnvValues...)
+}
+
+// Placeholder for the value of an environment variable, e.g. <env:API_KEY>
+var envPlaceholderPattern = regexp.MustCompile(`<env:([A-Za-z_][A-Za-z0-9_]*)(:[^<>]*)?>`)
+
+// Resolves the <env:VAR> placeholders in uri, body and user_agent of a provider.
+// An unset variable is an error, unless allowMissing is set or the placeholder has a default, e.g. <env:VAR:value>.
+func resolveEnvPlaceholders(p Provider, allowMissing bool) ([]placeholderValue, error) {
+	var values []placeholderValue
+	seen := map[string]bool{}
+	for _, template := range []string{p.Uri, p.Body, p.UserAgent} {
+		for _, match := range envPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+			name := match[1]
+			value, ok := os.LookupEnv(name)
+			// With a default, e.g. <env:VAR:value>, an unset variable is replaced by the default
+			if !ok && match[2] == "" && !seen["missing:"+name] {
+				if !allowMissing {
+					return nil, fmt.Errorf("references the unset environment variable %s", name)
+				}
+				seen["missing:"+name] = true
+				log.Printf("[WARNING] Environment variable %s is not set, <env:%s> is replaced by an empty value\n", name, name)
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			values = append(values, placeholderValue{"env:" + name, value})
+		}
+	}
+	return values, nil
+}
+
+// Returns the value of a placeholder for logging: <username>, <passwd> and <env:VAR> with a secret-looking name (e.g. API_KEY)
+// are masked, <domain> is masked according to LOG_MASK_DOMAIN
+func loggingPlaceholderValue(config *Config, v placeholderValue, escape func(string) string) string {
+	switch v.Name {
+	case "username", "passwd":
+		return "*****"
+	case "domain":
+		return logDomain(config, v.Value)
+	default:
+		// Values of environment variables with a secret-looking name, e.g. <env:API_KEY>
+		if name, isEnv := strings.CutPrefix(v.Name, "env:"); isEnv && isSensitiveHeader(name) {
+			return "*****"
+		}
+		return escape(v.Value)
+	}
+}
+
+// Replaces the placeholders in a template with the escaped values. The second result is for logging:
+// <username> and <passwd> are masked, <domain> is masked according to LOG_MASK_DOMAIN.
+// The template is scanned once, so a value that contains a placeholder, e.g. a passwd "<domain>", is not replaced again.
+func fillTemplate(config *Config, template string, values []placeholderValue, escape func(string) string) (string, string) {
+	var filled, logging strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start
+		value, ok := lookupPlaceholder(values, rest[start+1:end])
+		if !ok {
+			// Not a placeholder, e.g. "<" in a JSON body, the scan continues after it
+			filled.WriteString(rest[:start+1])
+			logging.WriteString(rest[:start+1])
+			rest = rest[start+1:]
+			continue
+		}
+		filled.WriteString(rest[:start])
+		filled.WriteString(escape(value.Value))
+		logging.WriteString(rest[:start])
+		logging.WriteString(loggingPlaceholderValue(config, value, escape))
+		rest = rest[end+1:]
+	}
+	filled.WriteString(rest)
+	logging.WriteString(rest)
+	return filled.String(), logging.String()
+}
+
+// Returns the value of a placeholder "name" or "name:default", e.g. "dualstack:0" or "env:API_KEY:none".
+// The default is used if the value is empty. It may contain colons, e.g. "ip6addr:::1".
+func lookupPlaceholder(values []placeholderValue, placeholder string) (placeholderValue, bool) {
+	find := func(name string) int {
+		return slices.IndexFunc(values, func(v placeholderValue) bool { return v.Name == name })
+	}
+	if index := find(placeholder); index >= 0 {
+		return values[index], true
+	}
+	// The name is the shortest prefix before a colon that is a placeholder, as <env:VAR> contains a colon itself
+	for offset := 0; ; {
+		colon := strings.IndexByte(placeholder[offset:], ':')
+		if colon < 0 {
+			return placeholderValue{}, false
+		}
+		if index := find(placeholder[:offset+colon]); index >= 0 {
+			value := values[index]
+			if value.Value == "" {
+				value.Value = placeholder[offset+colon+1:]
+			}
+			return value, true
+		}
+		offset += colon + 1
+	}
+}
+
+// Fills the placeholders of a URI template. The values are escaped for their position, so characters like
+// "&", "=", "#", "/", "@" or spaces can't change the structure of the URI: in the query with url.QueryEscape,
+// before it (userinfo and path) the same way, but with spaces as "%20", as "+" is not a space there.
+func fillUriTemplate(config *Config, template string, values []placeholderValue) (string, string) {
+	base, query, hasQuery := strings.Cut(template, "?")
+	filled, logging := fillTemplate(config, base, values, escapePathValue)
+	if hasQuery {
+		filledQuery, loggingQuery := fillTemplate(config, query, values, url.QueryEscape)
+		filled, logging = filled+"?"+filledQuery, logging+"?"+loggingQuery
+	}
+	return filled, logging
+}
+
+// Escapes a value for the userinfo or path of a URI
+func escapePathValue(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// Returns the escape function for placeholders in the body: JSON strings for JSON bodies, otherwise URL-encoding (form)
+func bodyEscaper(contentType string) func(string) string {
+	if strings.Contains(strings.ToLower(contentType), "json") {
+		return func(value string) string {
+			escaped, _ := json.Marshal(value)
+			return string(escaped[1 : len(escaped)-1])
+		}
+	}
+	return url.QueryEscape
+}
+
+// Replaces the URL in a *url.Error with the masked URL, as it contains the credentials of the provider
+func maskUrlError(err error, loggingUri string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &url.Error{Op: urlErr.Op, URL: loggingUri, Err: urlErr.Err}
+	}
+	return err
+}
+
+// Returns the URL of an incoming request for logging, with the value of the passwd query param masked
+func loggingRequestUrl(u *url.URL) string {
+	masked := *u
+	params := strings.Split(masked.RawQuery, "&")
+	for i, param := range params {
+		if name, _, _ := strings.Cut(param, "="); name == "passwd" {
+			params[i] = "passwd=*****"
+		}
+	}
+	masked.RawQuery = strings.Join(params, "&")
+	return masked.String()
+}
+
+// Result of a single request to a provider
+type providerAttempt struct {
+	Result     string      // provider result to match, e.g. a return code or the response body
+	Exact      bool        // Result is a return code and must match exactly
+	Body       string      // response body
+	StatusCode int         // HTTP status of the response, 0 if there is no response
+	Header     http.Header // response headers, nil if there is no response
+	Err        error       // the request failed, e.g. connection refused or timeout
+}
+
+// Default limit of the provider response bodies that are read, larger bodies are truncated
+const defaultMaxResponseBytes = 64 * 1024
+
+// Sends a single request to a provider and extracts the provider result from the response
+func sendProviderRequest(config *Config, i int, p Provider, uri string, loggingUri string, body string, r *http.Request, tracker *StatusTracker, span trace.Span, plog *ProviderLog) providerAttempt {
+	// Serialized providers are locked until the response body has been read
+	unlock := func() {}
+	if p.Serialize {
+		unlock = providerLocks.Lock(p)
+	}
+
+	// Make HTTP request with the shared client (timeout timeout_ms or HTTP_TIMEOUT_MS)
+	timeoutMs := config.HttpTimeoutMs
+	if p.TimeoutMs > 0 {
+		timeoutMs = p.TimeoutMs
+	}
+	plog.Verbosef("[REQUEST] Index=%d Timeout=%dms\n", i, timeoutMs)
+	// Derived from the incoming request, so the provider request is cancelled if the client disconnects
+	reqCtx, cancel := context.WithTimeout(r.Context(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	if p.RedirectAsSuccess {
+		reqCtx = context.WithValue(reqCtx, noRedirectKey{}, true)
+	}
+	method := http.MethodGet
+	var reqBody io.Reader
+	if p.Method != "" {
+		method = p.Method
+	}
+	if method != http.MethodGet {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, uri, reqBody)
+	if err != nil {
+		unlock()
+		plog.Printf("[ERROR] Index=%d URL=%s Error=%v\n", i, loggingUri, maskUrlError(err, loggingUri))
+		return providerAttempt{Result: "911", Exact: true}
+	}
+	if p.Auth == "basic" {
+		// The Authorization header is never logged
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	if reqBody != nil {
+		contentType := "application/x-www-form-urlencoded"
+		if p.ContentType != "" {
+			contentType = p.ContentType
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	span.SetAttributes(attribute.String("provider.host", req.URL.Hostname()))
+	userAgent := config.UserAgent
+	if p.UserAgent != "" {
+		userAgent, _ = fillTemplate(config, p.UserAgent, p.EnvValues, func(value string) string { return value })
+	}
+	req.Header.Set("User-Agent", buildUserAgent(userAgent, r.UserAgent()))
+	forwardHeaders(config, i, p, r, req, plog)
+	if p.DryRun {
+		unlock()
+		plog.Printf("[DRY-RUN] Index=%d URL=%s Method=%s, request not sent\n", i, loggingUri, req.Method)
+		return providerAttempt{Result: "good", Exact: true}
+	}
+	requestStart := clock.Now()
+	client := config.HttpClient
+	if p.HttpClient != nil {
+		client = p.HttpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		unlock()
+		observeProviderDuration(p, clock.Now().Sub(requestStart))
+		span.RecordError(maskUrlError(err, loggingUri))
+		if isCancelled(r, err) {
+			plog.Printf("[CANCELLED] Index=%d URL=%s Client disconnected, request cancelled\n", i, loggingUri)
+		} else if isTimeout(err) {
+			plog.Printf("[TIMEOUT] Index=%d URL=%s Error=%v\n", i, loggingUri, maskUrlError(err, loggingUri))
+		} else {
+			plog.Printf("[ERROR] Index=%d URL=%s Error=%v\n", i, loggingUri, maskUrlError(err, loggingUri))
+		}
+		return providerAttempt{Err: err}
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	// Read one byte more than the limit to detect truncation
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, int64(config.MaxResponseBytes)+1))
+	resp.Body.Close()
+	unlock()
+	observeProviderDuration(p, clock.Now().Sub(requestStart))
+	if err != nil {
+		span.RecordError(maskUrlError(err, loggingUri))
+		if isCancelled(r, err) {
+			plog.Printf("[CANCELLED] Index=%d URL=%s Status=%d Client disconnected while reading the response body\n", i, loggingUri, resp.StatusCode)
+		} else if isTimeout(err) {
+			plog.Printf("[TIMEOUT] Index=%d URL=%s Status=%d Error=reading response body: %v\n", i, loggingUri, resp.StatusCode, maskUrlError(err, loggingUri))
+		} else {
+			plog.Printf("[ERROR] Index=%d URL=%s Status=%d Error=reading response body: %v\n", i, loggingUri, resp.StatusCode, maskUrlError(err, loggingUri))
+		}
+		return providerAttempt{StatusCode: resp.StatusCode, Err: err}
+	}
+	if len(respBody) > config.MaxResponseBytes {
+		respBody = respBody[:config.MaxResponseBytes]
+		plog.Printf("[WARNING] Index=%d URL=%s Response body exceeds MAX_RESPONSE_BYTES (%d), only the first bytes are evaluated\n", i, loggingUri, config.MaxResponseBytes)
+	}
+
+	// The body and header values may echo the domain, e.g. "good example.com 1.2.3.4"
+	logText := func(text string) string {
+		return logDomainsIn(config, text, p.Domain, config.Domain)
+	}
+	logBody := logText(string(respBody))
+
+	if debugEnabled(config) {
+		//log response headers
+		plog.Verbosef("[RESPONSE-HEADERS] Index=%d URL=%s Status=%d Headers:", i, loggingUri, resp.StatusCode)
+		for k, v := range resp.Header {
+			plog.Verbosef("    %s: %s", k, logText(strings.Join(v, ", ")))
+		}
+	}
+
+	var providerResult string
+	exactReturnCodeMatch := false
+	if p.RequireStatus != 0 && resp.StatusCode != p.RequireStatus {
+		// Status-strict provider: any other status is a failure, regardless of headers and body
+		exactReturnCodeMatch = true
+		providerResult = "911"
+		plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d Body=%s RequireStatus=%d, treated as %s\n", i, loggingUri, resp.StatusCode, logBody, p.RequireStatus, providerResult)
+	} else if p.RedirectAsSuccess && resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		// Provider confirms the update with a redirect, which is not followed
+		exactReturnCodeMatch = true
+		providerResult = "good"
+		plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d Location=%s RedirectAsSuccess=%s\n", i, loggingUri, resp.StatusCode, logText(resp.Header.Get("Location")), providerResult)
+	} else if regexResult := matchResponseRegex(p, string(respBody), resp.Header); regexResult != "" {
+		// Provider without return codes: failure_regex and success_regex are evaluated before the return codes
+		exactReturnCodeMatch = true
+		providerResult = regexResult
+		plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d Body=%s ResponseRegex=%s\n", i, loggingUri, resp.StatusCode, logBody, providerResult)
+	} else if len(p.FailWhenContains) > 0 {
+		// 0. Provider only responds on failure: any listed token in the body is a failure, otherwise 2xx is good
+		exactReturnCodeMatch = true
+		providerResult = "good"
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			providerResult = "911"
+		}
+		for _, token := range p.FailWhenContains {
+			if strings.Contains(string(respBody), token) {
+				providerResult = "911"
+				break
+			}
+		}
+		plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d Body=%s FailWhenContains=%s\n", i, loggingUri, resp.StatusCode, logBody, providerResult)
+	} else if providerResult = resp.Header.Get("DDNSS-Response"); providerResult != "" {
+		// 1. check for exact return code match in header DDNSS-Response
+		// Extended evaluation: Header "DDNSS-Response" and "DDNSS-Message"
+		exactReturnCodeMatch = true
+		plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d DDNSS-Response=%s\n", i, loggingUri, resp.StatusCode, providerResult)
+		ddnssMessage := resp.Header.Get("DDNSS-Message")
+		if ddnssMessage != "" {
+			plog.Printf("[DDNSS-Message] Index=%d Message=%s\n", i, logText(ddnssMessage))
+		}
+	} else {
+		// 2. Check if a severity attribute exists as a header
+		severityFound := ""
+		// In the order of ReturnCodes, so the match doesn't depend on the map order if several headers are set
+		for _, sev := range tracker.ReturnCodes() {
+			if val := resp.Header.Get(sev); val != "" {
+				exactReturnCodeMatch = true
+				severityFound = sev
+				providerResult = sev
+				plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d SeverityHeader=%s\n", i, loggingUri, resp.StatusCode, sev)
+				break
+			}
+		}
+		if severityFound == "" {
+			//3. Fallback to body content
+			providerResult = string(respBody)
+			plog.Printf("[RESPONSE] Index=%d URL=%s Status=%d Body=%s\n", i, loggingUri, resp.StatusCode, logBody)
+		}
+	}
+
+	return providerAttempt{Result: providerResult, Exact: exactReturnCodeMatch, Body: string(respBody), StatusCode: resp.StatusCode, Header: resp.Header}
+}
+
+// Returns "911" if failure_regex matches the body or a header line (e.g. "X-Status: error"), "good" if success_regex matches,
+// and "" if neither matches, so the response is evaluated by the return codes. A failure match wins over a success match.
+func matchResponseRegex(p Provider, body string, header http.Header) string {
+	matches := func(re *regexp.Regexp) bool {
+		if re == nil {
+			return false
+		}
+		if re.MatchString(body) {
+			return true
+		}
+		for name, values := range header {
+			for _, value := range values {
+				if re.MatchString(name + ": " + value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case matches(p.FailureRegexParsed):
+		return "911"
+	case matches(p.SuccessRegexParsed):
+		return "good"
+	}
+	return ""
+}
+
+// Returns the IP addresses in a response body like "good 1.2.3.4 2001:db8::1", separated by a space.
+// IPv6 addresses are echoed according to RESPONSE_IP6_MODE. Returns "" if the body contains no IP address.
+func parseResponseIp(config *Config, body string) string {
+	var ips []string
+	for _, ip := range parseBodyIps(body) {
+		value := ip.String()
+		if ip.To4() == nil {
+			value = responseIp6(config, value)
+		}
+		if value != "" && !slices.Contains(ips, value) {
+			ips = append(ips, value)
+		}
+	}
+	return strings.Join(ips, " ")
+}
+
+// Returns all IP addresses in a response body
+func parseBodyIps(body string) []net.IP {
+	var ips []net.IP
+	for _, field := range strings.Fields(body) {
+		if ip := net.ParseIP(field); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Returns the IP addresses in the response body that are none of the sent addresses.
+// A body without an IP address can't be checked and returns nil.
+func staleResponseIps(body string, sent []string) []string {
+	var stale []string
+	for _, ip := range parseBodyIps(body) {
+		if !slices.ContainsFunc(sent, func(s string) bool { return ip.Equal(net.ParseIP(s)) }) {
+			stale = append(stale, ip.String())
+		}
+	}
+	return stale
+}
+
+// Returns true if the trimmed body is one of the sent addresses, e.g. "203.0.113.7" for the sent <ipaddr>
+func echoesSentIp(body string, sent []string) bool {
+	ip := net.ParseIP(strings.TrimSpace(body))
+	if ip == nil {
+		return false
+	}
+	return slices.ContainsFunc(sent, func(s string) bool { return s != "" && ip.Equal(net.ParseIP(s)) })
+}
+
+// Returns true if the error was caused by the client of the incoming request disconnecting
+func isCancelled(r *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) && r.Context().Err() != nil
+}
+
+// Returns true if the error is caused by a timeout or an exceeded deadline
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Returns the IPv6 address as it is echoed in the response line, according to RESPONSE_IP6_MODE
+func responseIp6(config *Config, ip6addr string) string {
+	switch config.ResponseIp6Mode {
+	case "omit":
+		return ""
+	case "mask":
+		ip := net.ParseIP(ip6addr)
+		if ip == nil || ip.To4() != nil {
+			return ip6addr
+		}
+		network := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+		return network.String()
+	}
+	return ip6addr
+}
+
+// Sets the summary headers of the provider fan-out
+func setProviderCountHeaders(w http.ResponseWriter, total, succeeded, failed int) {
+	w.Header().Set("X-Providers-Total", strconv.Itoa(total))
+	w.Header().Set("X-Providers-Succeeded", strconv.Itoa(succeeded))
+	w.Header().Set("X-Providers-Failed", strconv.Itoa(failed))
+}
+
+// Compares the credentials with the configuration in constant time.
+// Both values are always compared, so the response time does not reveal whether the username exists.
+func checkCredentials(config *Config, username, password string) (userKnown bool, passwordValid bool) {
+	userKnown = subtle.ConstantTimeCompare([]byte(username), []byte(config.Username)) == 1
+	passwordValid = subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) == 1
+	return userKnown, passwordValid
 }
 
 func responseWithError(w http.ResponseWriter, statusCode int, statusText string, infoMessage string) {
@@ -488,6 +5107,8 @@ func responseWithError(w http.ResponseWriter, statusCode int, statusText string,
 		log.Println(infoMessage)
 		w.Header().Set("Error-Message", infoMessage)
 	}
+	// No provider was contacted
+	setProviderCountHeaders(w, 0, 0, 0)
 	w.Header().Set(statusText, statusText)
 	http.Error(w, statusText, statusCode)
 }